@@ -0,0 +1,73 @@
+package cubequeue
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+)
+
+// ITransactionArchive keeps the expired transactions before they are removed from the database
+// The same transaction can be archived again if its removal failed, so the archive should tolerate the duplicates
+type ITransactionArchive interface {
+	Archive(ctx context.Context, transactions []*models.TransactionModel) error
+}
+
+// TransactionFileArchive appends the archived transactions to a file, one json document per line
+type TransactionFileArchive struct {
+	lock     sync.Mutex
+	path     string
+	compress bool
+}
+
+// NewTransactionFileArchive inits the archive writing to the given path, the compressed archive is a gzip file
+func NewTransactionFileArchive(path string, compress bool) *TransactionFileArchive {
+	return &TransactionFileArchive{
+		path:     path,
+		compress: compress,
+	}
+}
+
+// Archive appends the transactions to the file, they are synced to the disk before they are removed from the database
+// Every call to the compressed archive appends a new gzip member, the gzip readers read them as one stream
+func (archive *TransactionFileArchive) Archive(ctx context.Context, transactions []*models.TransactionModel) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	file, err := os.OpenFile(archive.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open the archive")
+	}
+	defer file.Close()
+	var writer io.Writer = file
+	var compressor *gzip.Writer
+	if archive.compress {
+		compressor = gzip.NewWriter(file)
+		writer = compressor
+	}
+	encoder := json.NewEncoder(writer)
+	for _, transaction := range transactions {
+		err = encoder.Encode(transaction)
+		if err != nil {
+			return errors.Wrap(err, "Cannot write the archive")
+		}
+	}
+	if compressor != nil {
+		err = compressor.Close()
+		if err != nil {
+			return errors.Wrap(err, "Cannot write the archive")
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "Cannot write the archive")
+	}
+	return nil
+}
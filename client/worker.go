@@ -1,13 +1,15 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/paladium/cubequeue"
 	"github.com/paladium/cubequeue/models"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 )
 
 // BackgroundWorkerSettings stores settings to configure background worker
@@ -15,11 +17,25 @@ type BackgroundWorkerSettings struct {
 	TransactionQueue  string
 	ServiceName       string
 	SubscribeSettings cubequeue.SubscribeSettings
+	// TransactionConfig is optional, if it is set the new transactions are validated against it
+	TransactionConfig *models.TransactionConfig
+	// ShutdownTimeout is how long Run waits for the messages being handled after the context is cancelled, zero waits until they finish
+	ShutdownTimeout time.Duration
+	// Retention removes the finished transactions from the database of the worker, it is disabled by default
+	Retention cubequeue.TransactionRetentionSettings
+}
+
+// The statuses the worker does not change its copy of the transaction in anymore, unlike the orchestrator the failed transaction is finished for the worker
+var workerRetentionStatuses = []models.TransactionStatus{
+	models.TransactionCompleted,
+	models.TransactionFailed,
+	models.TransactionRolledBack,
+	models.TransactionCompensationFailed,
 }
 
 // BackgroundWorker responsible for receiving background messages and processing transactions
 type BackgroundWorker struct {
-	transport *cubequeue.TransactionTransport
+	transport cubequeue.ITransactionTransport
 	database  cubequeue.ITransactionDatabase
 	settings  *BackgroundWorkerSettings
 }
@@ -37,7 +53,7 @@ func GetDefaultTransactionRoutingHandler() TransactionRoutingTableHandler {
 
 // NewBackgroundWorker inits the worker
 func NewBackgroundWorker(
-	transport *cubequeue.TransactionTransport,
+	transport cubequeue.ITransactionTransport,
 	database cubequeue.ITransactionDatabase,
 	settings *BackgroundWorkerSettings,
 ) *BackgroundWorker {
@@ -48,89 +64,276 @@ func NewBackgroundWorker(
 	}
 }
 
-func (backgroundWorker *BackgroundWorker) genericTransaction(message amqp.Delivery) (*models.TransactionModel, error) {
-	// Find the transaction first, if it does not exist, record it in db
-	transaction, err := backgroundWorker.database.Find(message.CorrelationId)
+// For now only work with json type, the message without the body has no payload
+func parseBody(message cubequeue.Message) (map[string]interface{}, error) {
+	if len(message.Body) == 0 {
+		return nil, nil
+	}
+	var body map[string]interface{}
+	err := json.Unmarshal(message.Body, &body)
 	if err != nil {
-		//For now only work with json type
-		var body map[string]interface{}
-		err = json.Unmarshal(message.Body, &body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Cannot unmarshal the body")
-		}
-		transaction, err = backgroundWorker.database.Create(&models.TransactionModel{
-			ID:      message.CorrelationId,
+		return nil, errors.Wrap(err, "Cannot unmarshal the body")
+	}
+	return body, nil
+}
+
+func (backgroundWorker *BackgroundWorker) genericTransaction(ctx context.Context, message cubequeue.Message, body map[string]interface{}) (*models.TransactionModel, error) {
+	// Find the transaction first, if it does not exist, record it in db
+	transaction, err := backgroundWorker.database.Find(ctx, message.CorrelationID)
+	if err == cubequeue.ErrTransactionNotFound {
+		return backgroundWorker.database.Create(ctx, &models.TransactionModel{
+			ID:      message.CorrelationID,
 			Type:    message.Type,
+			Status:  models.TransactionRunning,
 			Payload: body,
 		})
-		if err != nil {
-			return nil, err
-		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	//The duplicate message must not overwrite the payload changed by the handler
+	if transaction.IsProcessed(message.ID) {
+		return transaction, nil
+	}
+	//The orchestrator sends the payload enriched by the previous services, it replaces the one we have
+	//It is saved along with the result of the handler
+	if body != nil {
+		transaction.Payload = body
 	}
 	return transaction, nil
 }
 
-func (backgroundWorker *BackgroundWorker) publishErrorMessage(transaction *models.TransactionModel, errorMessage string) error {
-	return backgroundWorker.transport.Publish(backgroundWorker.settings.TransactionQueue, amqp.Publishing{
-		CorrelationId: transaction.ID,
-		Type:          transaction.Type,
-		Headers: amqp.Table{
+// The id of the message sent in reply is derived from the id of the received one, so the orchestrator recognizes the reply sent again for its duplicate
+func replyID(message cubequeue.Message, reply string) (string, error) {
+	if message.ID == "" {
+		return cubequeue.NewMessageID()
+	}
+	return message.ID + "-" + reply, nil
+}
+
+// The error is sent as the error message, the transaction type is kept in the header in case the transaction is new for the orchestrator
+func (backgroundWorker *BackgroundWorker) publishErrorMessage(message cubequeue.Message, errorMessage string) error {
+	id, err := replyID(message, "error")
+	if err != nil {
+		return err
+	}
+	return backgroundWorker.transport.Publish(backgroundWorker.settings.TransactionQueue, cubequeue.Message{
+		ID:            id,
+		CorrelationID: message.CorrelationID,
+		Type:          cubequeue.ErrorMessage,
+		Headers: map[string]interface{}{
 			"origin": backgroundWorker.settings.ServiceName,
 			"error":  errorMessage,
+			"type":   message.Type,
 		},
 	})
 }
 
-func (backgroundWorker *BackgroundWorker) continueTransaction(transaction *models.TransactionModel) error {
+func (backgroundWorker *BackgroundWorker) continueTransaction(message cubequeue.Message, transaction *models.TransactionModel) error {
 	body, err := json.Marshal(transaction.Payload)
 	if err != nil {
 		return errors.Wrap(err, "Cannot marshal the json")
 	}
-	return backgroundWorker.transport.Publish(backgroundWorker.settings.TransactionQueue, amqp.Publishing{
-		CorrelationId: transaction.ID,
+	id, err := replyID(message, "ack")
+	if err != nil {
+		return err
+	}
+	return backgroundWorker.transport.Publish(backgroundWorker.settings.TransactionQueue, cubequeue.Message{
+		ID:            id,
+		CorrelationID: transaction.ID,
 		Type:          transaction.Type,
 		Body:          body,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": backgroundWorker.settings.ServiceName,
 		},
 	})
 }
 
-func (backgroundWorker *BackgroundWorker) handleTransaction(message amqp.Delivery, handler TransactionRoutingTableHandler) error {
-	transaction, err := backgroundWorker.genericTransaction(message)
+func (backgroundWorker *BackgroundWorker) handleTransaction(ctx context.Context, message cubequeue.Message, handler TransactionRoutingTableHandler) error {
+	body, err := parseBody(message)
+	if err != nil {
+		return backgroundWorker.publishErrorMessage(message, err.Error())
+	}
+	//The storage failure is returned, so the message is delivered again
+	transaction, err := backgroundWorker.genericTransaction(ctx, message, body)
+	if err != nil {
+		return err
+	}
+	if transaction.IsProcessed(message.ID) {
+		//The handler already ran for the message, only the reply could be lost, so it is sent again
+		logrus.WithField("transaction", transaction.ID).WithField("message", message.ID).Debug("Ignoring the duplicate message")
+		switch transaction.Status {
+		case models.TransactionRunning:
+			return backgroundWorker.continueTransaction(message, transaction)
+		case models.TransactionFailed:
+			return backgroundWorker.publishErrorMessage(message, transaction.FailureError())
+		}
+		return nil
+	}
+	err = handler(transaction)
+	//The message is recorded along with the result of the handler, so the handler never runs twice for it
+	transaction.MarkProcessed(message.ID)
+	//Every run of the handler is kept as a stage, so the error can be sent again for the duplicate message
+	stage := models.TransactionStageModel{
+		Service: backgroundWorker.settings.ServiceName,
+		Queue:   backgroundWorker.settings.SubscribeSettings.Queue,
+		Ack:     true,
+		Date:    time.Now(),
+	}
+	if err != nil {
+		errorMessage := err.Error()
+		stage.Error = &errorMessage
+		transaction.AddStage(stage)
+		backgroundWorker.setStatus(ctx, transaction, models.TransactionFailed)
+		return backgroundWorker.publishErrorMessage(message, errorMessage)
+	}
+	transaction.AddStage(stage)
+	//The stage could be retried by the orchestrator after it failed
+	transaction.Status = models.TransactionRunning
+	transaction, err = backgroundWorker.database.Update(ctx, transaction.ID, transaction)
+	if err != nil {
+		return err
+	}
+	return backgroundWorker.continueTransaction(message, transaction)
+}
+
+func (backgroundWorker *BackgroundWorker) publishCompensationResult(message cubequeue.Message, compensationError error) error {
+	headers := map[string]interface{}{
+		"origin": backgroundWorker.settings.ServiceName,
+		"stage":  message.Headers["stage"],
+	}
+	messageType := cubequeue.RollbackAckMessage
+	if compensationError != nil {
+		messageType = cubequeue.RollbackErrorMessage
+		headers["error"] = compensationError.Error()
+	}
+	id, err := replyID(message, "result")
+	if err != nil {
+		return err
+	}
+	return backgroundWorker.transport.Publish(backgroundWorker.settings.TransactionQueue, cubequeue.Message{
+		ID:            id,
+		CorrelationID: message.CorrelationID,
+		Type:          messageType,
+		Headers:       headers,
+	})
+}
+
+func (backgroundWorker *BackgroundWorker) compensate(ctx context.Context, message cubequeue.Message, rollbackTable TransactionRoutingTable) error {
+	transaction, err := backgroundWorker.database.Find(ctx, message.CorrelationID)
 	if err != nil {
-		return backgroundWorker.publishErrorMessage(transaction, err.Error())
+		return err
+	}
+	if transaction.IsProcessed(message.ID) {
+		//The compensation already ran for the message, only its result is sent again
+		if transaction.Status == models.TransactionCompensationFailed {
+			return errors.New("The compensation already failed")
+		}
+		return nil
+	}
+	handler, ok := rollbackTable[transaction.Type]
+	if !ok {
+		return errors.Errorf("No rollback handler for %s", transaction.Type)
 	}
 	err = handler(transaction)
+	transaction.MarkProcessed(message.ID)
 	if err != nil {
-		return backgroundWorker.publishErrorMessage(transaction, err.Error())
+		backgroundWorker.setStatus(ctx, transaction, models.TransactionCompensationFailed)
+		return err
+	}
+	backgroundWorker.setStatus(ctx, transaction, models.TransactionRolledBack)
+	return nil
+}
+
+// Keep the status of the local copy of the transaction, failing to save it does not change the outcome of the handler
+func (backgroundWorker *BackgroundWorker) setStatus(ctx context.Context, transaction *models.TransactionModel, status models.TransactionStatus) {
+	transaction.Status = status
+	_, err := backgroundWorker.database.Update(ctx, transaction.ID, transaction)
+	if err != nil {
+		logrus.WithError(err).WithField("transaction", transaction.ID).Warn("Cannot save the transaction status")
 	}
-	return backgroundWorker.continueTransaction(transaction)
 }
 
 // This function wraps around handler for rollbacks and executes handler for the transaction that matches the one that should be rolled back
-func (backgroundWorker *BackgroundWorker) handleRollback(rollbackTable TransactionRoutingTable) func(message amqp.Delivery) error {
-	return func(message amqp.Delivery) error {
-		// Find the transaction first, if it does not exist, record it in db
-		transaction, err := backgroundWorker.database.Find(message.CorrelationId)
+// The result of the compensation is always reported back to the orchestrator, so it can retry the failed ones
+func (backgroundWorker *BackgroundWorker) handleRollback(rollbackTable TransactionRoutingTable) func(message cubequeue.Message) error {
+	return func(message cubequeue.Message) error {
+		//The handlers are not cancelled along with Run, so the messages being handled are finished during the shutdown
+		err := backgroundWorker.compensate(context.Background(), message, rollbackTable)
 		if err != nil {
-			return err
+			logrus.WithError(err).WithField("transaction", message.CorrelationID).Warn("Cannot rollback the transaction")
+		}
+		return backgroundWorker.publishCompensationResult(message, err)
+	}
+}
+
+// StartTransaction records a new transaction and publishes it to the queue of the worker, so it is processed like any other transaction
+// The returned handle reports the status of the local copy of the transaction
+func (backgroundWorker *BackgroundWorker) StartTransaction(ctx context.Context, transactionType string, payload map[string]interface{}, options cubequeue.StartTransactionOptions) (*cubequeue.TransactionHandle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if transactionConfig := backgroundWorker.settings.TransactionConfig; transactionConfig != nil {
+		transaction, ok := transactionConfig.Transactions[transactionType]
+		if !ok {
+			return nil, errors.Errorf("Transaction type %s cannot be found", transactionType)
+		}
+		if len(transaction.Stages) == 0 || transaction.Stages[0] != backgroundWorker.settings.ServiceName {
+			return nil, errors.Errorf("The transaction %s does not start with %s", transactionType, backgroundWorker.settings.ServiceName)
 		}
-		err = rollbackTable[transaction.Type](transaction)
+	}
+	id := options.ID
+	if id == "" {
+		var err error
+		id, err = cubequeue.NewTransactionID()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return nil
 	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot marshal the json")
+	}
+	_, err = backgroundWorker.database.Create(ctx, &models.TransactionModel{
+		ID:      id,
+		Type:    transactionType,
+		Status:  models.TransactionRunning,
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]interface{}{}
+	for key, value := range options.Headers {
+		headers[key] = value
+	}
+	headers["origin"] = backgroundWorker.settings.ServiceName
+	messageID, err := cubequeue.NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+	err = backgroundWorker.transport.Publish(backgroundWorker.settings.SubscribeSettings.Queue, cubequeue.Message{
+		ID:            messageID,
+		CorrelationID: id,
+		Type:          transactionType,
+		Body:          body,
+		Headers:       headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cubequeue.NewTransactionHandle(id, transactionType, backgroundWorker.database), nil
 }
 
 // Run the background worker
-func (backgroundWorker *BackgroundWorker) Run(transactionRoutingTable TransactionRoutingTable, rollbackTable TransactionRoutingTable) error {
+// Run blocks until the context is cancelled, then it stops consuming, waits for the messages being handled and closes the connections
+func (backgroundWorker *BackgroundWorker) Run(ctx context.Context, transactionRoutingTable TransactionRoutingTable, rollbackTable TransactionRoutingTable) error {
 	routingTable := cubequeue.RoutingTable{}
 	for key, handler := range transactionRoutingTable {
-		routingTable[key] = func(message amqp.Delivery) error {
+		handler := handler
+		routingTable[key] = func(message cubequeue.Message) error {
 			//Save transaction or update current status of it
-			err := backgroundWorker.handleTransaction(message, handler)
+			err := backgroundWorker.handleTransaction(context.Background(), message, handler)
 			if err != nil {
 				return err
 			}
@@ -139,16 +342,59 @@ func (backgroundWorker *BackgroundWorker) Run(transactionRoutingTable Transactio
 	}
 	//Add the rollback handling route
 	routingTable[cubequeue.RollbackMessage] = backgroundWorker.handleRollback(rollbackTable)
+	//The retention runs for as long as we are subscribed
+	backgroundContext, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	var background sync.WaitGroup
+	if backgroundWorker.settings.Retention.Interval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			cubequeue.RunRetention(backgroundContext, backgroundWorker.database, backgroundWorker.retentionSettings())
+		}()
+	}
 	logrus.Debug("Running the worker")
-	err := backgroundWorker.transport.Subscribe(routingTable, backgroundWorker.settings.SubscribeSettings)
-	if err != nil {
-		return err
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- backgroundWorker.transport.Subscribe(ctx, routingTable, backgroundWorker.settings.SubscribeSettings)
+	}()
+	select {
+	case err := <-subscribed:
+		if ctx.Err() == nil {
+			return err
+		}
+	case <-ctx.Done():
+		var expired <-chan time.Time
+		if backgroundWorker.settings.ShutdownTimeout > 0 {
+			expired = time.After(backgroundWorker.settings.ShutdownTimeout)
+		}
+		select {
+		case err := <-subscribed:
+			if err != nil {
+				logrus.WithError(err).Warn("The subscription stopped with an error")
+			}
+		case <-expired:
+			logrus.Warn("The messages being handled did not finish in time, closing the worker anyway")
+		}
 	}
+	stopBackground()
+	background.Wait()
+	backgroundWorker.Close()
+	logrus.Debug("The worker stopped")
 	return nil
 }
 
+// The retention settings of the worker, the statuses finished for the worker are used unless they are set
+func (backgroundWorker *BackgroundWorker) retentionSettings() cubequeue.TransactionRetentionSettings {
+	settings := backgroundWorker.settings.Retention
+	if len(settings.Statuses) == 0 {
+		settings.Statuses = workerRetentionStatuses
+	}
+	return settings
+}
+
 // Close all connections
 func (backgroundWorker *BackgroundWorker) Close() {
 	backgroundWorker.transport.Close()
-	backgroundWorker.database.Close()
+	backgroundWorker.database.Close(context.Background())
 }
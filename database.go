@@ -1,11 +1,33 @@
 package cubequeue
 
-import "github.com/paladium/cubequeue/models"
+import (
+	"context"
+
+	"github.com/paladium/cubequeue/models"
+)
+
+// ErrTransactionNotFound is returned by the database when the transaction does not exist
+var ErrTransactionNotFound = models.ErrTransactionNotFound
 
 // ITransactionDatabase is a contract that has to be implemented in order to allow for persistence of the transactions
+// Find and Update return ErrTransactionNotFound if the transaction does not exist, any other error is a storage failure
 type ITransactionDatabase interface {
-	Find(id string) (*models.TransactionModel, error)
-	Create(transaction *models.TransactionModel) (*models.TransactionModel, error)
-	Update(id string, transaction *models.TransactionModel) (*models.TransactionModel, error)
-	Close()
+	Find(ctx context.Context, id string) (*models.TransactionModel, error)
+	FindByStatus(ctx context.Context, status models.TransactionStatus) ([]*models.TransactionModel, error)
+	// FindWithOutbox finds the transactions that have unpublished messages in the outbox
+	FindWithOutbox(ctx context.Context) ([]*models.TransactionModel, error)
+	Create(ctx context.Context, transaction *models.TransactionModel) (*models.TransactionModel, error)
+	// Update saves the transaction only if its version is the same as the saved one and increases the version
+	// models.VersionConflictError is returned if the transaction was changed since it was loaded
+	Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error)
+	// FindExpired finds the transactions matching the retention filter, the least recently updated first
+	FindExpired(ctx context.Context, filter models.RetentionFilter) ([]*models.TransactionModel, error)
+	// Delete removes the transaction only if its version is the same as the saved one, the same as Update
+	Delete(ctx context.Context, id string, version int) error
+	Close(ctx context.Context)
+}
+
+// ITransactionQueryDatabase is implemented by the databases that can list the transactions matching the query
+type ITransactionQueryDatabase interface {
+	Query(ctx context.Context, query models.TransactionQuery) (*models.TransactionPage, error)
 }
@@ -0,0 +1,273 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets of the bolt database, the indexes keep the keys only, the transactions are kept in their own bucket
+var (
+	boltTransactionsBucket = []byte("transactions")
+	boltTypeIndexBucket    = []byte("index_type")
+	boltStatusIndexBucket  = []byte("index_status")
+	boltOutboxIndexBucket  = []byte("index_outbox")
+)
+
+// TransactionBoltDatabase implementation of ITransactionDatabase that keeps the transactions in a local file using bbolt
+// It needs no database server, so it fits the single node deployments, the file can be opened by one process at a time
+type TransactionBoltDatabase struct {
+	db *bolt.DB
+}
+
+// NewTransactionBoltDatabase opens the database file, it is created if it does not exist
+// Every write is synced to the disk before it returns, so the saved transactions survive a crash
+func NewTransactionBoltDatabase(path string) (*TransactionBoltDatabase, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		//Another process holding the file makes the open fail instead of waiting forever
+		Timeout: 5 * time.Second,
+		//The commits are synced to the disk
+		NoSync: false,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot open the database")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltTransactionsBucket, boltTypeIndexBucket, boltStatusIndexBucket, boltOutboxIndexBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Cannot create the buckets")
+	}
+	return &TransactionBoltDatabase{db: db}, nil
+}
+
+// The key of the index starts with the indexed value, so the transactions with the same value are next to each other
+func boltIndexKey(value string, id string) []byte {
+	return []byte(value + "\x00" + id)
+}
+
+func decodeBoltTransaction(document []byte) (*models.TransactionModel, error) {
+	transaction := new(models.TransactionModel)
+	err := json.Unmarshal(document, transaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the model")
+	}
+	return transaction, nil
+}
+
+// Remove the index entries of the saved transaction
+func removeBoltIndexes(tx *bolt.Tx, transaction *models.TransactionModel) error {
+	err := tx.Bucket(boltTypeIndexBucket).Delete(boltIndexKey(transaction.Type, transaction.ID))
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltStatusIndexBucket).Delete(boltIndexKey(string(transaction.Status), transaction.ID))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltOutboxIndexBucket).Delete([]byte(transaction.ID))
+}
+
+// Save the transaction along with its index entries
+func putBoltTransaction(tx *bolt.Tx, transaction *models.TransactionModel) error {
+	document, err := json.Marshal(transaction)
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode the model")
+	}
+	err = tx.Bucket(boltTransactionsBucket).Put([]byte(transaction.ID), document)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltTypeIndexBucket).Put(boltIndexKey(transaction.Type, transaction.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltStatusIndexBucket).Put(boltIndexKey(string(transaction.Status), transaction.ID), []byte{})
+	if err != nil {
+		return err
+	}
+	if len(transaction.Outbox) > 0 {
+		return tx.Bucket(boltOutboxIndexBucket).Put([]byte(transaction.ID), []byte{})
+	}
+	return nil
+}
+
+// Find a given model in the bolt database
+func (database *TransactionBoltDatabase) Find(ctx context.Context, id string) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var transaction *models.TransactionModel
+	err := database.db.View(func(tx *bolt.Tx) error {
+		document := tx.Bucket(boltTransactionsBucket).Get([]byte(id))
+		if document == nil {
+			return models.ErrTransactionNotFound
+		}
+		var err error
+		transaction, err = decodeBoltTransaction(document)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// Find the transactions by the ids kept in the index under the given prefix
+func (database *TransactionBoltDatabase) findIndexed(ctx context.Context, index []byte, prefix []byte) ([]*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	transactions := []*models.TransactionModel{}
+	err := database.db.View(func(tx *bolt.Tx) error {
+		documents := tx.Bucket(boltTransactionsBucket)
+		cursor := tx.Bucket(index).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			document := documents.Get(key[len(prefix):])
+			if document == nil {
+				return errors.Errorf("The index %s points to the missing transaction %s", index, key[len(prefix):])
+			}
+			transaction, err := decodeBoltTransaction(document)
+			if err != nil {
+				return err
+			}
+			transactions = append(transactions, transaction)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// FindByStatus finds all the transactions with a given status
+func (database *TransactionBoltDatabase) FindByStatus(ctx context.Context, status models.TransactionStatus) ([]*models.TransactionModel, error) {
+	return database.findIndexed(ctx, boltStatusIndexBucket, boltIndexKey(string(status), ""))
+}
+
+// FindByType finds all the transactions of a given type
+func (database *TransactionBoltDatabase) FindByType(ctx context.Context, transactionType string) ([]*models.TransactionModel, error) {
+	return database.findIndexed(ctx, boltTypeIndexBucket, boltIndexKey(transactionType, ""))
+}
+
+// FindWithOutbox finds all the transactions with unpublished messages
+func (database *TransactionBoltDatabase) FindWithOutbox(ctx context.Context) ([]*models.TransactionModel, error) {
+	return database.findIndexed(ctx, boltOutboxIndexBucket, []byte{})
+}
+
+// FindExpired finds the transactions matching the retention filter, the least recently updated first
+func (database *TransactionBoltDatabase) FindExpired(ctx context.Context, filter models.RetentionFilter) ([]*models.TransactionModel, error) {
+	candidates, err := database.findIndexed(ctx, boltStatusIndexBucket, boltIndexKey(string(filter.Status), ""))
+	if err != nil {
+		return nil, err
+	}
+	transactions := []*models.TransactionModel{}
+	for _, transaction := range candidates {
+		if filter.Matches(transaction) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	return leastRecentlyUpdated(transactions, filter.Limit), nil
+}
+
+// Create saves the transaction in the bolt database, it fails if the transaction with the same id already exists
+func (database *TransactionBoltDatabase) Create(ctx context.Context, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err := database.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltTransactionsBucket).Get([]byte(transaction.ID)) != nil {
+			return errors.Errorf("The transaction %s already exists", transaction.ID)
+		}
+		transaction.Touch(time.Now())
+		return putBoltTransaction(tx, transaction)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// Update updates the transaction in the bolt database if its version did not change since it was loaded
+// The version of the given transaction is increased, VersionConflictError is returned if the version does not match
+func (database *TransactionBoltDatabase) Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	version := transaction.Version
+	err := database.db.Update(func(tx *bolt.Tx) error {
+		document := tx.Bucket(boltTransactionsBucket).Get([]byte(id))
+		if document == nil {
+			return models.ErrTransactionNotFound
+		}
+		current, err := decodeBoltTransaction(document)
+		if err != nil {
+			return err
+		}
+		//The id cannot be changed by the update, the same as in mongodb
+		if transaction.ID != id {
+			return errors.Errorf("Cannot change the id of the transaction %s", id)
+		}
+		if current.Version != version {
+			return &models.VersionConflictError{ID: id, Version: version}
+		}
+		err = removeBoltIndexes(tx, current)
+		if err != nil {
+			return err
+		}
+		transaction.Version = version + 1
+		transaction.Touch(time.Now())
+		return putBoltTransaction(tx, transaction)
+	})
+	if err != nil {
+		transaction.Version = version
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// Delete removes the transaction from the bolt database if its version did not change since it was loaded
+func (database *TransactionBoltDatabase) Delete(ctx context.Context, id string, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return database.db.Update(func(tx *bolt.Tx) error {
+		document := tx.Bucket(boltTransactionsBucket).Get([]byte(id))
+		if document == nil {
+			return models.ErrTransactionNotFound
+		}
+		current, err := decodeBoltTransaction(document)
+		if err != nil {
+			return err
+		}
+		if current.Version != version {
+			return &models.VersionConflictError{ID: id, Version: version}
+		}
+		err = removeBoltIndexes(tx, current)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltTransactionsBucket).Delete([]byte(id))
+	})
+}
+
+// Close the database file
+func (database *TransactionBoltDatabase) Close(ctx context.Context) {
+	database.db.Close()
+}
@@ -0,0 +1,158 @@
+package databases
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanSaveTransactionInBolt(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	database, err := NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.db"))
+	assert.Nil(t, err)
+	_, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	_, err = database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+	})
+	assert.Nil(t, err)
+	//The same transaction cannot be created twice
+	_, err = database.Create(context.Background(), &models.TransactionModel{ID: "fa621107-5b79-4e8b-9587-df064f1052b4"})
+	assert.NotNil(t, err)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	transaction.Status = models.TransactionCompleted
+	_, err = database.Update(context.Background(), transaction.ID, transaction)
+	assert.Nil(t, err)
+	_, err = database.Update(context.Background(), "82941436-9940-42c9-9f30-9f82a0861457", &models.TransactionModel{ID: "82941436-9940-42c9-9f30-9f82a0861457"})
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	database.Close(context.Background())
+	//The transaction is kept in the file once the database is opened again
+	database, err = NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.db"))
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionCompleted, transaction.Status)
+	assert.Equal(t, 1, transaction.Version)
+	assert.Equal(t, "34555678", transaction.Payload["invoiceNumber"])
+}
+
+func TestCannotUpdateChangedTransactionInBolt(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	database, err := NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.db"))
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	_, err = database.Create(context.Background(), &models.TransactionModel{
+		ID:     "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:   "invoice.create",
+		Status: models.TransactionRunning,
+	})
+	assert.Nil(t, err)
+	//Two instances load the same transaction
+	first, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	second, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	first.Status = models.TransactionCompleted
+	_, err = database.Update(context.Background(), first.ID, first)
+	assert.Nil(t, err)
+	//The second one cannot overwrite the change of the first one
+	second.Status = models.TransactionFailed
+	_, err = database.Update(context.Background(), second.ID, second)
+	assert.True(t, models.IsVersionConflict(err))
+	assert.Equal(t, 0, second.Version)
+	failed, err := database.FindByStatus(context.Background(), models.TransactionFailed)
+	assert.Nil(t, err)
+	assert.Empty(t, failed)
+}
+
+func TestCanFindIndexedTransactionsInBolt(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	database, err := NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.db"))
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	stage := 1
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionRunning},
+		{ID: "2", Type: "invoice.create", Status: models.TransactionFailed},
+		{ID: "3", Type: "account.create", Status: models.TransactionRunning, Outbox: []models.OutboxMessageModel{{Queue: "cube-billing", Stage: &stage}}},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	running, err := database.FindByStatus(context.Background(), models.TransactionRunning)
+	assert.Nil(t, err)
+	assert.Len(t, running, 2)
+	invoices, err := database.FindByType(context.Background(), "invoice.create")
+	assert.Nil(t, err)
+	assert.Len(t, invoices, 2)
+	assert.Equal(t, "1", invoices[0].ID)
+	assert.Equal(t, "2", invoices[1].ID)
+	outbox, err := database.FindWithOutbox(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, outbox, 1)
+	assert.Equal(t, "3", outbox[0].ID)
+	//The indexes follow the changes of the transaction
+	transaction := outbox[0]
+	transaction.Outbox = nil
+	transaction.Status = models.TransactionCompleted
+	_, err = database.Update(context.Background(), transaction.ID, transaction)
+	assert.Nil(t, err)
+	outbox, err = database.FindWithOutbox(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, outbox)
+	running, err = database.FindByStatus(context.Background(), models.TransactionRunning)
+	assert.Nil(t, err)
+	assert.Len(t, running, 1)
+	assert.Equal(t, "1", running[0].ID)
+}
+
+func TestCanDeleteExpiredTransactionsInBolt(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	database, err := NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.db"))
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionCompleted},
+		{ID: "2", Type: "account.create", Status: models.TransactionCompleted},
+		{ID: "3", Type: "invoice.create", Status: models.TransactionRunning},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	expired, err := database.FindExpired(context.Background(), models.RetentionFilter{
+		Status:        models.TransactionCompleted,
+		Type:          "invoice.create",
+		UpdatedBefore: time.Now().Add(time.Hour),
+	})
+	assert.Nil(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "1", expired[0].ID)
+	//The transaction changed since it was loaded is not deleted
+	assert.True(t, models.IsVersionConflict(database.Delete(context.Background(), "1", 1)))
+	assert.Nil(t, database.Delete(context.Background(), "1", 0))
+	assert.Equal(t, models.ErrTransactionNotFound, database.Delete(context.Background(), "1", 0))
+	//The indexes of the deleted transaction are removed as well
+	invoices, err := database.FindByType(context.Background(), "invoice.create")
+	assert.Nil(t, err)
+	assert.Len(t, invoices, 1)
+	assert.Equal(t, "3", invoices[0].ID)
+}
@@ -0,0 +1,222 @@
+package databases
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TransactionMemoryDatabase implementation of ITransactionDatabase that keeps the transactions in the memory of the process
+// It is useful for the lightweight workers and the unit tests, the transactions are lost once the process stops
+type TransactionMemoryDatabase struct {
+	lock         sync.RWMutex
+	transactions map[string][]byte
+	//The ids in the order of creation, so the transactions are listed in the same order as they were saved
+	ids []string
+}
+
+// NewTransactionMemoryDatabase inits an empty database
+func NewTransactionMemoryDatabase() *TransactionMemoryDatabase {
+	return &TransactionMemoryDatabase{
+		transactions: map[string][]byte{},
+	}
+}
+
+// The transactions are kept encoded, so the changes of the returned models are not visible until they are saved
+func encodeTransaction(transaction *models.TransactionModel) ([]byte, error) {
+	document, err := bson.Marshal(transaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot encode the model")
+	}
+	return document, nil
+}
+
+func decodeTransaction(document []byte) (*models.TransactionModel, error) {
+	transaction := new(models.TransactionModel)
+	err := bson.Unmarshal(document, transaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the model")
+	}
+	return transaction, nil
+}
+
+// Find a given model in memory
+func (database *TransactionMemoryDatabase) Find(ctx context.Context, id string) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	document, ok := database.transactions[id]
+	if !ok {
+		return nil, models.ErrTransactionNotFound
+	}
+	return decodeTransaction(document)
+}
+
+// Find the transactions matching the filter in the order of creation
+func (database *TransactionMemoryDatabase) findAll(ctx context.Context, filter func(transaction *models.TransactionModel) bool) ([]*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	database.lock.RLock()
+	defer database.lock.RUnlock()
+	transactions := []*models.TransactionModel{}
+	for _, id := range database.ids {
+		transaction, err := decodeTransaction(database.transactions[id])
+		if err != nil {
+			return nil, err
+		}
+		if filter(transaction) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	return transactions, nil
+}
+
+// FindByStatus finds all the transactions with a given status
+func (database *TransactionMemoryDatabase) FindByStatus(ctx context.Context, status models.TransactionStatus) ([]*models.TransactionModel, error) {
+	return database.findAll(ctx, func(transaction *models.TransactionModel) bool {
+		return transaction.Status == status
+	})
+}
+
+// FindWithOutbox finds all the transactions with unpublished messages
+func (database *TransactionMemoryDatabase) FindWithOutbox(ctx context.Context) ([]*models.TransactionModel, error) {
+	return database.findAll(ctx, func(transaction *models.TransactionModel) bool {
+		return len(transaction.Outbox) > 0
+	})
+}
+
+// FindExpired finds the transactions matching the retention filter, the least recently updated first
+func (database *TransactionMemoryDatabase) FindExpired(ctx context.Context, filter models.RetentionFilter) ([]*models.TransactionModel, error) {
+	transactions, err := database.findAll(ctx, filter.Matches)
+	if err != nil {
+		return nil, err
+	}
+	return leastRecentlyUpdated(transactions, filter.Limit), nil
+}
+
+// Query finds a page of the transactions matching the query
+func (database *TransactionMemoryDatabase) Query(ctx context.Context, query models.TransactionQuery) (*models.TransactionPage, error) {
+	cursor, err := decodeQueryCursor(&query)
+	if err != nil {
+		return nil, err
+	}
+	transactions, err := database.findAll(ctx, func(transaction *models.TransactionModel) bool {
+		return query.Matches(transaction) && (cursor == nil || cursor.precedes(&query, transaction))
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		first, second := transactions[i], transactions[j]
+		if query.Descending {
+			first, second = second, first
+		}
+		if query.SortDate(first).Equal(query.SortDate(second)) {
+			return first.ID < second.ID
+		}
+		return query.SortDate(first).Before(query.SortDate(second))
+	})
+	page := &models.TransactionPage{Transactions: transactions}
+	if len(transactions) > query.GetLimit() {
+		page.Transactions = transactions[:query.GetLimit()]
+		page.NextCursor, err = encodeQueryCursor(&query, page.Transactions[len(page.Transactions)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Create saves the transaction in memory, it fails if the transaction with the same id already exists
+func (database *TransactionMemoryDatabase) Create(ctx context.Context, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	transaction.Touch(time.Now())
+	document, err := encodeTransaction(transaction)
+	if err != nil {
+		return nil, err
+	}
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	if _, ok := database.transactions[transaction.ID]; ok {
+		return nil, errors.Errorf("The transaction %s already exists", transaction.ID)
+	}
+	database.transactions[transaction.ID] = document
+	database.ids = append(database.ids, transaction.ID)
+	return transaction, nil
+}
+
+// Update updates the transaction in memory if its version did not change since it was loaded
+// The version of the given transaction is increased, VersionConflictError is returned if the version does not match
+func (database *TransactionMemoryDatabase) Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	saved, ok := database.transactions[id]
+	if !ok {
+		return nil, models.ErrTransactionNotFound
+	}
+	current, err := decodeTransaction(saved)
+	if err != nil {
+		return nil, err
+	}
+	//The id cannot be changed by the update, the same as in mongodb
+	if transaction.ID != id {
+		return nil, errors.Errorf("Cannot change the id of the transaction %s", id)
+	}
+	version := transaction.Version
+	if current.Version != version {
+		return nil, &models.VersionConflictError{ID: id, Version: version}
+	}
+	transaction.Version = version + 1
+	transaction.Touch(time.Now())
+	document, err := encodeTransaction(transaction)
+	if err != nil {
+		transaction.Version = version
+		return nil, err
+	}
+	database.transactions[id] = document
+	return transaction, nil
+}
+
+// Delete removes the transaction from memory if its version did not change since it was loaded
+func (database *TransactionMemoryDatabase) Delete(ctx context.Context, id string, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	saved, ok := database.transactions[id]
+	if !ok {
+		return models.ErrTransactionNotFound
+	}
+	current, err := decodeTransaction(saved)
+	if err != nil {
+		return err
+	}
+	if current.Version != version {
+		return &models.VersionConflictError{ID: id, Version: version}
+	}
+	delete(database.transactions, id)
+	for index, savedID := range database.ids {
+		if savedID == id {
+			database.ids = append(database.ids[:index], database.ids[index+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Close the database, the transactions are kept, so the database can still be used
+func (database *TransactionMemoryDatabase) Close(ctx context.Context) {}
@@ -0,0 +1,147 @@
+package databases
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanSaveTransactionInMemory(t *testing.T) {
+	database := NewTransactionMemoryDatabase()
+	defer database.Close(context.Background())
+	_, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	_, err = database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+	})
+	assert.Nil(t, err)
+	//The same transaction cannot be created twice
+	_, err = database.Create(context.Background(), &models.TransactionModel{ID: "fa621107-5b79-4e8b-9587-df064f1052b4"})
+	assert.NotNil(t, err)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, "34555678", transaction.Payload["invoiceNumber"])
+	//The changes are not visible until they are saved
+	transaction.Payload["invoiceNumber"] = "34555679"
+	saved, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, "34555678", saved.Payload["invoiceNumber"])
+	transaction, err = database.Update(context.Background(), transaction.ID, transaction)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, transaction.Version)
+	saved, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, "34555679", saved.Payload["invoiceNumber"])
+	assert.Equal(t, 1, saved.Version)
+	_, err = database.Update(context.Background(), "82941436-9940-42c9-9f30-9f82a0861457", &models.TransactionModel{ID: "82941436-9940-42c9-9f30-9f82a0861457"})
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+}
+
+func TestCannotUpdateChangedTransactionInMemory(t *testing.T) {
+	database := NewTransactionMemoryDatabase()
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:     "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:   "invoice.create",
+		Status: models.TransactionRunning,
+	})
+	assert.Nil(t, err)
+	//Two instances load the same transaction
+	first, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	second, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	first.Status = models.TransactionCompleted
+	_, err = database.Update(context.Background(), first.ID, first)
+	assert.Nil(t, err)
+	//The second one cannot overwrite the change of the first one
+	second.Status = models.TransactionFailed
+	_, err = database.Update(context.Background(), second.ID, second)
+	assert.True(t, models.IsVersionConflict(err))
+	assert.Equal(t, 0, second.Version)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionCompleted, transaction.Status)
+}
+
+func TestCanFindTransactionsInMemory(t *testing.T) {
+	database := NewTransactionMemoryDatabase()
+	stage := 1
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Status: models.TransactionRunning},
+		{ID: "2", Status: models.TransactionFailed},
+		{ID: "3", Status: models.TransactionRunning, Outbox: []models.OutboxMessageModel{{Queue: "cube-billing", Stage: &stage}}},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	running, err := database.FindByStatus(context.Background(), models.TransactionRunning)
+	assert.Nil(t, err)
+	assert.Len(t, running, 2)
+	assert.Equal(t, "1", running[0].ID)
+	assert.Equal(t, "3", running[1].ID)
+	outbox, err := database.FindWithOutbox(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, outbox, 1)
+	assert.Equal(t, "3", outbox[0].ID)
+	assert.Equal(t, 1, *outbox[0].Outbox[0].Stage)
+	//The cancelled context stops the query
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = database.FindByStatus(ctx, models.TransactionRunning)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCanQueryTransactionsInMemory(t *testing.T) {
+	database := NewTransactionMemoryDatabase()
+	failure := "Cannot charge the card"
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "2", Type: "invoice.create", Status: models.TransactionRunning, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing"}}},
+		{ID: "3", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "4", Type: "account.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "5", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	hasError := true
+	query := models.TransactionQuery{
+		Types:    []string{"invoice.create"},
+		Statuses: []models.TransactionStatus{models.TransactionFailed},
+		Service:  "billing",
+		HasError: &hasError,
+		Limit:    2,
+	}
+	page, err := database.Query(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 2)
+	assert.Equal(t, "1", page.Transactions[0].ID)
+	assert.Equal(t, "3", page.Transactions[1].ID)
+	assert.NotEmpty(t, page.NextCursor)
+	//The next page starts after the last transaction of the previous one
+	query.Cursor = page.NextCursor
+	page, err = database.Query(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "5", page.Transactions[0].ID)
+	assert.Empty(t, page.NextCursor)
+	//The newest transactions come first
+	page, err = database.Query(context.Background(), models.TransactionQuery{Descending: true, Limit: 3})
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 3)
+	assert.Equal(t, "5", page.Transactions[0].ID)
+	assert.Equal(t, "3", page.Transactions[2].ID)
+	page, err = database.Query(context.Background(), models.TransactionQuery{Descending: true, Limit: 3, Cursor: page.NextCursor})
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 2)
+	assert.Equal(t, "2", page.Transactions[0].ID)
+	assert.Equal(t, "1", page.Transactions[1].ID)
+	_, err = database.Query(context.Background(), models.TransactionQuery{Cursor: "not a cursor"})
+	assert.NotNil(t, err)
+}
@@ -2,6 +2,7 @@ package databases
 
 import (
 	"context"
+	"time"
 
 	"github.com/paladium/cubequeue/models"
 	"github.com/pkg/errors"
@@ -35,10 +36,13 @@ func NewTransactionMongoDBDatabase(url string, db string, collection string) (*T
 }
 
 // Find a given model in mongodb database
-func (database *TransactionMongoDBDatabase) Find(id string) (*models.TransactionModel, error) {
-	result := database.transactionsCollection.FindOne(context.Background(), bson.M{"_id": id})
+func (database *TransactionMongoDBDatabase) Find(ctx context.Context, id string) (*models.TransactionModel, error) {
+	result := database.transactionsCollection.FindOne(ctx, bson.M{"_id": id})
+	if result.Err() == mongo.ErrNoDocuments {
+		return nil, models.ErrTransactionNotFound
+	}
 	if result.Err() != nil {
-		return nil, result.Err()
+		return nil, errors.Wrap(result.Err(), "Cannot find the model")
 	}
 	transaction := new(models.TransactionModel)
 	err := result.Decode(transaction)
@@ -48,33 +52,254 @@ func (database *TransactionMongoDBDatabase) Find(id string) (*models.Transaction
 	return transaction, nil
 }
 
+// FindByStatus finds all the transactions with a given status
+func (database *TransactionMongoDBDatabase) FindByStatus(ctx context.Context, status models.TransactionStatus) ([]*models.TransactionModel, error) {
+	cursor, err := database.transactionsCollection.Find(ctx, bson.M{"status": status})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	transactions := []*models.TransactionModel{}
+	err = cursor.All(ctx, &transactions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the models")
+	}
+	return transactions, nil
+}
+
+// FindWithOutbox finds all the transactions with unpublished messages
+func (database *TransactionMongoDBDatabase) FindWithOutbox(ctx context.Context) ([]*models.TransactionModel, error) {
+	cursor, err := database.transactionsCollection.Find(ctx, bson.M{"outbox.0": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	transactions := []*models.TransactionModel{}
+	err = cursor.All(ctx, &transactions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the models")
+	}
+	return transactions, nil
+}
+
+// FindExpired finds the transactions matching the retention filter, the least recently updated first
+func (database *TransactionMongoDBDatabase) FindExpired(ctx context.Context, filter models.RetentionFilter) ([]*models.TransactionModel, error) {
+	//The transactions saved without the date of the update do not match
+	conditions := bson.M{
+		"status":    filter.Status,
+		"updatedat": bson.M{"$lt": filter.UpdatedBefore},
+	}
+	if filter.Type != "" {
+		conditions["type"] = filter.Type
+	} else if len(filter.ExcludeTypes) > 0 {
+		conditions["type"] = bson.M{"$nin": filter.ExcludeTypes}
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "updatedat", Value: 1}, {Key: "_id", Value: 1}})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := database.transactionsCollection.Find(ctx, conditions, findOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	transactions := []*models.TransactionModel{}
+	err = cursor.All(ctx, &transactions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the models")
+	}
+	return transactions, nil
+}
+
+// Query finds a page of the transactions matching the query, CreateIndexes creates the indexes used by the queries
+func (database *TransactionMongoDBDatabase) Query(ctx context.Context, query models.TransactionQuery) (*models.TransactionPage, error) {
+	cursor, err := decodeQueryCursor(&query)
+	if err != nil {
+		return nil, err
+	}
+	sortBy := string(query.GetSortBy())
+	conditions := bson.A{}
+	if len(query.Types) > 0 {
+		conditions = append(conditions, bson.M{"type": bson.M{"$in": query.Types}})
+	}
+	if len(query.Statuses) > 0 {
+		conditions = append(conditions, bson.M{"status": bson.M{"$in": query.Statuses}})
+	}
+	if query.Service != "" {
+		conditions = append(conditions, bson.M{"currentservices": query.Service})
+	}
+	if query.HasError != nil {
+		failed := bson.M{"stages": bson.M{"$elemMatch": bson.M{"error": bson.M{"$ne": nil}}}}
+		if *query.HasError {
+			conditions = append(conditions, failed)
+		} else {
+			conditions = append(conditions, bson.M{"$nor": bson.A{failed}})
+		}
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, bson.M{sortBy: bson.M{"$gte": query.From}})
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, bson.M{sortBy: bson.M{"$lt": query.To}})
+	}
+	direction := 1
+	after := "$gt"
+	if query.Descending {
+		direction = -1
+		after = "$lt"
+	}
+	if cursor != nil {
+		//The next page starts after the last transaction of the previous one, the transactions with the same date are ordered by id
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{sortBy: bson.M{after: cursor.Date}},
+			bson.M{sortBy: cursor.Date, "_id": bson.M{after: cursor.ID}},
+		}})
+	}
+	filter := bson.M{}
+	if len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+	limit := query.GetLimit()
+	//One more transaction is loaded to know if there is the next page
+	results, err := database.transactionsCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: sortBy, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(limit+1)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	transactions := []*models.TransactionModel{}
+	err = results.All(ctx, &transactions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the models")
+	}
+	page := &models.TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.NextCursor, err = encodeQueryCursor(&query, page.Transactions[limit-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// CreateIndexes creates the indexes used by the queries, the existing indexes are kept
+func (database *TransactionMongoDBDatabase) CreateIndexes(ctx context.Context) error {
+	_, err := database.transactionsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "createdat", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "updatedat", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdat", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updatedat", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "status", Value: 1}, {Key: "createdat", Value: 1}}},
+		{Keys: bson.D{{Key: "currentservices", Value: 1}, {Key: "status", Value: 1}, {Key: "createdat", Value: 1}}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Cannot create the indexes")
+	}
+	return nil
+}
+
 // Create saves the transaction in db
-func (database *TransactionMongoDBDatabase) Create(transaction *models.TransactionModel) (*models.TransactionModel, error) {
-	_, err := database.transactionsCollection.InsertOne(context.Background(), transaction)
+func (database *TransactionMongoDBDatabase) Create(ctx context.Context, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	transaction.Touch(time.Now())
+	_, err := database.transactionsCollection.InsertOne(ctx, transaction)
 	if err != nil {
 		return nil, err
 	}
 	return transaction, nil
 }
 
-// Update updates the transaction in db
-func (database *TransactionMongoDBDatabase) Update(id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
-	_, err := database.transactionsCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": id},
+// Update updates the transaction in db if its version did not change since it was loaded
+// The version of the given transaction is increased, VersionConflictError is returned if the version does not match
+func (database *TransactionMongoDBDatabase) Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	version := transaction.Version
+	filter := bson.M{"_id": id, "version": version}
+	if version == 0 {
+		//The transactions saved before the versioning have no version
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	transaction.Version = version + 1
+	transaction.Touch(time.Now())
+	result, err := database.transactionsCollection.UpdateOne(
+		ctx,
+		filter,
 		bson.M{
 			"$set": transaction,
 		},
 	)
 	if err != nil {
+		transaction.Version = version
 		return nil, errors.Wrap(err, "Cannot update the model")
 	}
-	return database.Find(id)
+	if result.MatchedCount == 0 {
+		transaction.Version = version
+		count, err := database.transactionsCollection.CountDocuments(ctx, bson.M{"_id": id})
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot update the model")
+		}
+		if count == 0 {
+			return nil, models.ErrTransactionNotFound
+		}
+		return nil, &models.VersionConflictError{ID: id, Version: version}
+	}
+	return transaction, nil
+}
+
+// Delete removes the transaction from db if its version did not change since it was loaded
+func (database *TransactionMongoDBDatabase) Delete(ctx context.Context, id string, version int) error {
+	filter := bson.M{"_id": id, "version": version}
+	if version == 0 {
+		//The transactions saved before the versioning have no version
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	result, err := database.transactionsCollection.DeleteOne(ctx, filter)
+	if err != nil {
+		return errors.Wrap(err, "Cannot delete the model")
+	}
+	if result.DeletedCount == 0 {
+		count, err := database.transactionsCollection.CountDocuments(ctx, bson.M{"_id": id})
+		if err != nil {
+			return errors.Wrap(err, "Cannot delete the model")
+		}
+		if count == 0 {
+			return models.ErrTransactionNotFound
+		}
+		return &models.VersionConflictError{ID: id, Version: version}
+	}
+	return nil
 }
 
 // Close the connection to the database
-func (database *TransactionMongoDBDatabase) Close() {
-	database.client.Disconnect(context.Background())
+func (database *TransactionMongoDBDatabase) Close(ctx context.Context) {
+	database.client.Disconnect(ctx)
+}
+
+// TransactionMongoDBArchive keeps the expired transactions in another collection of the same database
+type TransactionMongoDBArchive struct {
+	collection *mongo.Collection
+}
+
+// NewArchive returns the archive using the given collection, it shares the connection with the database
+func (database *TransactionMongoDBDatabase) NewArchive(collection string) *TransactionMongoDBArchive {
+	return &TransactionMongoDBArchive{
+		collection: database.db.Collection(collection),
+	}
+}
+
+// Archive saves the transactions in the archive collection, the transaction archived again replaces the previous copy
+func (archive *TransactionMongoDBArchive) Archive(ctx context.Context, transactions []*models.TransactionModel) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+	writes := []mongo.WriteModel{}
+	for _, transaction := range transactions {
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": transaction.ID}).
+			SetReplacement(transaction).
+			SetUpsert(true))
+	}
+	_, err := archive.collection.BulkWrite(ctx, writes)
+	if err != nil {
+		return errors.Wrap(err, "Cannot archive the models")
+	}
+	return nil
 }
 
 // DeleteDatabase drops the database
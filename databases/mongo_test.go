@@ -0,0 +1,130 @@
+package databases
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCannotUpdateChangedTransaction(t *testing.T) {
+	database, err := NewTransactionMongoDBDatabase("mongodb://localhost:27017", "cubequeue", "transactions")
+	require.Nil(t, err)
+	defer database.Close(context.Background())
+	defer database.DeleteDatabase()
+	_, err = database.Create(context.Background(), &models.TransactionModel{
+		ID:     "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:   "invoice.create",
+		Status: models.TransactionRunning,
+	})
+	require.Nil(t, err)
+	//Two instances load the same transaction
+	first, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	require.Nil(t, err)
+	second, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	require.Nil(t, err)
+	first.Status = models.TransactionCompleted
+	first, err = database.Update(context.Background(), first.ID, first)
+	require.Nil(t, err)
+	assert.Equal(t, 1, first.Version)
+	//The second one cannot overwrite the change of the first one
+	second.Status = models.TransactionFailed
+	_, err = database.Update(context.Background(), second.ID, second)
+	assert.True(t, models.IsVersionConflict(err))
+	assert.Equal(t, 0, second.Version)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	require.Nil(t, err)
+	assert.Equal(t, models.TransactionCompleted, transaction.Status)
+	assert.Equal(t, 1, transaction.Version)
+}
+
+func TestCanRecognizeMissingTransaction(t *testing.T) {
+	database, err := NewTransactionMongoDBDatabase("mongodb://localhost:27017", "cubequeue", "transactions")
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	defer database.DeleteDatabase()
+	_, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+	_, err = database.Update(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4", &models.TransactionModel{ID: "fa621107-5b79-4e8b-9587-df064f1052b4"})
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+}
+
+func TestCanQueryTransactions(t *testing.T) {
+	database, err := NewTransactionMongoDBDatabase("mongodb://localhost:27017", "cubequeue", "transactions")
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	defer database.DeleteDatabase()
+	assert.Nil(t, database.CreateIndexes(context.Background()))
+	failure := "Cannot charge the card"
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "2", Type: "invoice.create", Status: models.TransactionRunning, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing"}}},
+		{ID: "3", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "4", Type: "account.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+		{ID: "5", Type: "invoice.create", Status: models.TransactionFailed, Stages: []models.TransactionStageModel{{Order: 0, Service: "billing", Error: &failure}}},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	hasError := true
+	query := models.TransactionQuery{
+		Types:    []string{"invoice.create"},
+		Statuses: []models.TransactionStatus{models.TransactionFailed},
+		Service:  "billing",
+		HasError: &hasError,
+		Limit:    2,
+	}
+	page, err := database.Query(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 2)
+	assert.Equal(t, "1", page.Transactions[0].ID)
+	assert.Equal(t, "3", page.Transactions[1].ID)
+	//The next page starts after the last transaction of the previous one
+	query.Cursor = page.NextCursor
+	page, err = database.Query(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "5", page.Transactions[0].ID)
+	assert.Empty(t, page.NextCursor)
+	hasError = false
+	page, err = database.Query(context.Background(), models.TransactionQuery{HasError: &hasError})
+	assert.Nil(t, err)
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "2", page.Transactions[0].ID)
+}
+
+func TestCanArchiveExpiredTransactions(t *testing.T) {
+	database, err := NewTransactionMongoDBDatabase("mongodb://localhost:27017", "cubequeue", "transactions")
+	assert.Nil(t, err)
+	defer database.Close(context.Background())
+	defer database.DeleteDatabase()
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionCompleted},
+		{ID: "2", Type: "account.create", Status: models.TransactionCompleted},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	expired, err := database.FindExpired(context.Background(), models.RetentionFilter{
+		Status:        models.TransactionCompleted,
+		ExcludeTypes:  []string{"account.create"},
+		UpdatedBefore: time.Now().Add(time.Hour),
+	})
+	assert.Nil(t, err)
+	assert.Len(t, expired, 1)
+	archive := database.NewArchive("archive")
+	//Archiving the same transaction again replaces the previous copy
+	assert.Nil(t, archive.Archive(context.Background(), expired))
+	assert.Nil(t, archive.Archive(context.Background(), expired))
+	count, err := database.db.Collection("archive").CountDocuments(context.Background(), bson.M{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.True(t, models.IsVersionConflict(database.Delete(context.Background(), "1", 1)))
+	assert.Nil(t, database.Delete(context.Background(), "1", 0))
+	_, err = database.Find(context.Background(), "1")
+	assert.Equal(t, models.ErrTransactionNotFound, err)
+}
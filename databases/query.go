@@ -0,0 +1,67 @@
+package databases
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+)
+
+// The position of the last transaction of the page, the next page starts after it
+type queryCursor struct {
+	Date time.Time
+	ID   string
+}
+
+func encodeQueryCursor(query *models.TransactionQuery, transaction *models.TransactionModel) (string, error) {
+	cursor, err := json.Marshal(queryCursor{
+		Date: query.SortDate(transaction),
+		ID:   transaction.ID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot encode the cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(cursor), nil
+}
+
+func decodeQueryCursor(query *models.TransactionQuery) (*queryCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, errors.Wrap(err, "The cursor is not valid")
+	}
+	cursor := new(queryCursor)
+	err = json.Unmarshal(encoded, cursor)
+	if err != nil {
+		return nil, errors.Wrap(err, "The cursor is not valid")
+	}
+	return cursor, nil
+}
+
+// Returns true if the cursor comes before the transaction in the order of the query
+func (cursor *queryCursor) precedes(query *models.TransactionQuery, transaction *models.TransactionModel) bool {
+	date := query.SortDate(transaction)
+	if query.Descending {
+		return date.Before(cursor.Date) || (date.Equal(cursor.Date) && transaction.ID < cursor.ID)
+	}
+	return date.After(cursor.Date) || (date.Equal(cursor.Date) && transaction.ID > cursor.ID)
+}
+
+// Sort the transactions by the date of the update and keep the given number of them, zero keeps all of them
+func leastRecentlyUpdated(transactions []*models.TransactionModel, limit int) []*models.TransactionModel {
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].UpdatedAt.Equal(transactions[j].UpdatedAt) {
+			return transactions[i].ID < transactions[j].ID
+		}
+		return transactions[i].UpdatedAt.Before(transactions[j].UpdatedAt)
+	})
+	if limit > 0 && len(transactions) > limit {
+		return transactions[:limit]
+	}
+	return transactions
+}
@@ -0,0 +1,342 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+)
+
+// SQLDialect describes the differences between the supported sql databases
+type SQLDialect struct {
+	Name string
+	// DocumentType is the type of the column that keeps the transaction encoded as json
+	DocumentType string
+	// TimeType is the type of the columns that keep the dates
+	TimeType string
+	// Placeholder returns the parameter of the query at the given position, starting at 1
+	Placeholder func(position int) string
+}
+
+// Supported dialects
+var (
+	PostgresDialect = SQLDialect{
+		Name:         "postgres",
+		DocumentType: "JSONB",
+		TimeType:     "TIMESTAMPTZ",
+		Placeholder: func(position int) string {
+			return fmt.Sprintf("$%d", position)
+		},
+	}
+	SQLiteDialect = SQLDialect{
+		Name:         "sqlite",
+		DocumentType: "TEXT",
+		TimeType:     "TIMESTAMP",
+		Placeholder: func(position int) string {
+			return "?"
+		},
+	}
+)
+
+// GetSQLDialect returns the dialect used with the given database/sql driver
+func GetSQLDialect(driver string) (SQLDialect, error) {
+	switch driver {
+	case "postgres", "pgx":
+		return PostgresDialect, nil
+	case "sqlite3", "sqlite":
+		return SQLiteDialect, nil
+	}
+	return SQLDialect{}, errors.Errorf("The driver %s is not supported", driver)
+}
+
+// The migrations of the schema, each one is applied once in its own transaction, the new ones are only appended
+// The columns besides the document are kept for the queries, the document is the source of truth
+var sqlMigrations = []func(table string, dialect SQLDialect) []string{
+	func(table string, dialect SQLDialect) []string {
+		return []string{
+			fmt.Sprintf(`CREATE TABLE %s (
+				id VARCHAR(255) PRIMARY KEY,
+				version INTEGER NOT NULL,
+				type VARCHAR(255) NOT NULL,
+				status VARCHAR(64) NOT NULL,
+				outbox INTEGER NOT NULL,
+				document %s NOT NULL,
+				created_at %s NOT NULL,
+				updated_at %s NOT NULL
+			)`, table, dialect.DocumentType, dialect.TimeType, dialect.TimeType),
+			fmt.Sprintf("CREATE INDEX %s_status ON %s (status)", table, table),
+			fmt.Sprintf("CREATE INDEX %s_outbox ON %s (outbox) WHERE outbox > 0", table, table),
+		}
+	},
+	func(table string, dialect SQLDialect) []string {
+		return []string{
+			fmt.Sprintf("CREATE INDEX %s_status_updated ON %s (status, updated_at)", table, table),
+		}
+	},
+}
+
+// TransactionSQLDatabase implementation of ITransactionDatabase using database/sql, it works with postgresql and sqlite
+// The driver of the database has to be imported by the application, for example github.com/lib/pq or github.com/mattn/go-sqlite3
+type TransactionSQLDatabase struct {
+	db      *sql.DB
+	dialect SQLDialect
+	table   string
+}
+
+// NewTransactionSQLDatabase connects to the database and migrates the table for storing transactions
+func NewTransactionSQLDatabase(driver string, url string, table string) (*TransactionSQLDatabase, error) {
+	dialect, err := GetSQLDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot connect to the database")
+	}
+	if dialect.Name == SQLiteDialect.Name {
+		//Sqlite allows only one writer, the single connection makes the writes wait for each other instead of failing
+		db.SetMaxOpenConns(1)
+	}
+	database := &TransactionSQLDatabase{
+		db:      db,
+		dialect: dialect,
+		table:   table,
+	}
+	err = database.Migrate(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return database, nil
+}
+
+// Migrate applies the migrations of the schema that were not applied yet
+func (database *TransactionSQLDatabase) Migrate(ctx context.Context) error {
+	migrations := database.table + "_migrations"
+	_, err := database.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, date %s NOT NULL)", migrations, database.dialect.TimeType))
+	if err != nil {
+		return errors.Wrap(err, "Cannot create the migrations table")
+	}
+	var applied int
+	err = database.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", migrations)).Scan(&applied)
+	if err != nil {
+		return errors.Wrap(err, "Cannot find the applied migrations")
+	}
+	for version := applied; version < len(sqlMigrations); version++ {
+		tx, err := database.db.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "Cannot start the migration")
+		}
+		for _, statement := range sqlMigrations[version](database.table, database.dialect) {
+			_, err = tx.ExecContext(ctx, statement)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrapf(err, "Cannot apply the migration %d", version+1)
+			}
+		}
+		//The version is the primary key, so two instances cannot apply the same migration
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (version, date) VALUES (%s, %s)", migrations, database.dialect.Placeholder(1), database.dialect.Placeholder(2)), version+1, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "Cannot apply the migration %d", version+1)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return errors.Wrapf(err, "Cannot apply the migration %d", version+1)
+		}
+	}
+	return nil
+}
+
+func decodeSQLTransaction(document []byte) (*models.TransactionModel, error) {
+	transaction := new(models.TransactionModel)
+	err := json.Unmarshal(document, transaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot decode the model")
+	}
+	return transaction, nil
+}
+
+// Find a given model in sql database
+func (database *TransactionSQLDatabase) Find(ctx context.Context, id string) (*models.TransactionModel, error) {
+	var document []byte
+	err := database.db.QueryRowContext(ctx, fmt.Sprintf("SELECT document FROM %s WHERE id = %s", database.table, database.dialect.Placeholder(1)), id).Scan(&document)
+	if err == sql.ErrNoRows {
+		return nil, models.ErrTransactionNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the model")
+	}
+	return decodeSQLTransaction(document)
+}
+
+// Find the models matching the condition, the order can be followed by the limit
+func (database *TransactionSQLDatabase) findAll(ctx context.Context, condition string, order string, args ...interface{}) ([]*models.TransactionModel, error) {
+	rows, err := database.db.QueryContext(ctx, fmt.Sprintf("SELECT document FROM %s WHERE %s ORDER BY %s", database.table, condition, order), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	defer rows.Close()
+	transactions := []*models.TransactionModel{}
+	for rows.Next() {
+		var document []byte
+		err = rows.Scan(&document)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot find the models")
+		}
+		transaction, err := decodeSQLTransaction(document)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot find the models")
+	}
+	return transactions, nil
+}
+
+// FindByStatus finds all the transactions with a given status
+func (database *TransactionSQLDatabase) FindByStatus(ctx context.Context, status models.TransactionStatus) ([]*models.TransactionModel, error) {
+	return database.findAll(ctx, "status = "+database.dialect.Placeholder(1), "created_at, id", string(status))
+}
+
+// FindWithOutbox finds all the transactions with unpublished messages
+func (database *TransactionSQLDatabase) FindWithOutbox(ctx context.Context) ([]*models.TransactionModel, error) {
+	return database.findAll(ctx, "outbox > 0", "created_at, id")
+}
+
+// FindExpired finds the transactions matching the retention filter, the least recently updated first
+func (database *TransactionSQLDatabase) FindExpired(ctx context.Context, filter models.RetentionFilter) ([]*models.TransactionModel, error) {
+	placeholder := database.dialect.Placeholder
+	condition := fmt.Sprintf("status = %s AND updated_at < %s", placeholder(1), placeholder(2))
+	args := []interface{}{string(filter.Status), filter.UpdatedBefore.UTC()}
+	if filter.Type != "" {
+		args = append(args, filter.Type)
+		condition += fmt.Sprintf(" AND type = %s", placeholder(len(args)))
+	} else {
+		for _, excluded := range filter.ExcludeTypes {
+			args = append(args, excluded)
+			condition += fmt.Sprintf(" AND type <> %s", placeholder(len(args)))
+		}
+	}
+	order := "updated_at, id"
+	if filter.Limit > 0 {
+		order += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	return database.findAll(ctx, condition, order, args...)
+}
+
+// Create saves the transaction in db
+func (database *TransactionSQLDatabase) Create(ctx context.Context, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	now := time.Now().UTC()
+	transaction.Touch(now)
+	document, err := json.Marshal(transaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot encode the model")
+	}
+	placeholder := database.dialect.Placeholder
+	_, err = database.db.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"INSERT INTO %s (id, version, type, status, outbox, document, created_at, updated_at) VALUES (%s, %s, %s, %s, %s, %s, %s, %s)",
+			database.table, placeholder(1), placeholder(2), placeholder(3), placeholder(4), placeholder(5), placeholder(6), placeholder(7), placeholder(8),
+		),
+		transaction.ID, transaction.Version, transaction.Type, string(transaction.Status), len(transaction.Outbox), string(document), transaction.CreatedAt, now,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot create the model")
+	}
+	return transaction, nil
+}
+
+// Update updates the transaction in db if its version did not change since it was loaded
+// The version of the given transaction is increased, VersionConflictError is returned if the version does not match
+func (database *TransactionSQLDatabase) Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	version := transaction.Version
+	transaction.Version = version + 1
+	now := time.Now().UTC()
+	transaction.Touch(now)
+	document, err := json.Marshal(transaction)
+	if err != nil {
+		transaction.Version = version
+		return nil, errors.Wrap(err, "Cannot encode the model")
+	}
+	placeholder := database.dialect.Placeholder
+	result, err := database.db.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"UPDATE %s SET version = %s, type = %s, status = %s, outbox = %s, document = %s, updated_at = %s WHERE id = %s AND version = %s",
+			database.table, placeholder(1), placeholder(2), placeholder(3), placeholder(4), placeholder(5), placeholder(6), placeholder(7), placeholder(8),
+		),
+		transaction.Version, transaction.Type, string(transaction.Status), len(transaction.Outbox), string(document), now, id, version,
+	)
+	if err != nil {
+		transaction.Version = version
+		return nil, errors.Wrap(err, "Cannot update the model")
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		transaction.Version = version
+		return nil, errors.Wrap(err, "Cannot update the model")
+	}
+	if updated == 0 {
+		transaction.Version = version
+		var count int
+		err = database.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = %s", database.table, placeholder(1)), id).Scan(&count)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot update the model")
+		}
+		if count == 0 {
+			return nil, models.ErrTransactionNotFound
+		}
+		return nil, &models.VersionConflictError{ID: id, Version: version}
+	}
+	return transaction, nil
+}
+
+// Delete removes the transaction from db if its version did not change since it was loaded
+func (database *TransactionSQLDatabase) Delete(ctx context.Context, id string, version int) error {
+	placeholder := database.dialect.Placeholder
+	result, err := database.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = %s AND version = %s", database.table, placeholder(1), placeholder(2)), id, version)
+	if err != nil {
+		return errors.Wrap(err, "Cannot delete the model")
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Cannot delete the model")
+	}
+	if deleted == 0 {
+		var count int
+		err = database.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = %s", database.table, placeholder(1)), id).Scan(&count)
+		if err != nil {
+			return errors.Wrap(err, "Cannot delete the model")
+		}
+		if count == 0 {
+			return models.ErrTransactionNotFound
+		}
+		return &models.VersionConflictError{ID: id, Version: version}
+	}
+	return nil
+}
+
+// Close the connection to the database
+func (database *TransactionSQLDatabase) Close(ctx context.Context) {
+	database.db.Close()
+}
+
+// DeleteDatabase drops the tables of the transactions
+func (database *TransactionSQLDatabase) DeleteDatabase() error {
+	for _, table := range []string{database.table, database.table + "_migrations"} {
+		_, err := database.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+		if err != nil {
+			return errors.Wrap(err, "Cannot delete the database")
+		}
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ For example when you receive account.create message you should create a new acco
 */
 
 import (
+	"context"
 	"os"
 
 	"github.com/mitchellh/mapstructure"
@@ -49,7 +50,7 @@ func main() {
 		TransactionQueue:  "cubequeue",
 		SubscribeSettings: cubequeue.GetDefaultSubscribeSettings(queue),
 	})
-	worker.Run(client.TransactionRoutingTable{
+	worker.Run(context.Background(), client.TransactionRoutingTable{
 		"account.create": func(transaction *models.TransactionModel) error {
 			//Save the account to database
 			createAccount := struct {
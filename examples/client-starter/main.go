@@ -4,7 +4,10 @@ package main
 The starter example - minimum example that shows how to use client part of the library to execute and process transactions
 */
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/paladium/cubequeue"
 	"github.com/paladium/cubequeue/client"
@@ -21,6 +24,18 @@ func setLogging() {
 	logrus.SetLevel(logrus.DebugLevel)
 }
 
+// Cancel the context on SIGINT or SIGTERM, so the running messages are finished before exiting
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	return ctx
+}
+
 func main() {
 	queue := "billing"
 	//Setup the logging
@@ -44,7 +59,7 @@ func main() {
 		TransactionQueue:  "cubequeue",
 		SubscribeSettings: cubequeue.GetDefaultSubscribeSettings(queue),
 	})
-	worker.Run(client.TransactionRoutingTable{
+	worker.Run(shutdownContext(), client.TransactionRoutingTable{
 		"account.create": client.GetDefaultTransactionRoutingHandler(),
 	}, client.TransactionRoutingTable{
 		"account.create": client.GetDefaultTransactionRoutingHandler(),
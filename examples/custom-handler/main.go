@@ -6,13 +6,13 @@ For example, you can send an example, every time a new user is registered or mak
 */
 
 import (
+	"context"
 	"os"
 
 	"github.com/paladium/cubequeue"
 	"github.com/paladium/cubequeue/databases"
 	"github.com/paladium/cubequeue/models"
 	"github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 )
 
 func setLogging() {
@@ -69,15 +69,21 @@ func main() {
 				Description: "Propagates a new added payment card (masked pan, expiration data)",
 				Stages: []string{
 					"backend",
-					"billing",
-					"admin",
+					"notify",
+				},
+				//Billing and admin do not depend on each other, so they receive the card at the same time
+				Groups: map[string][]string{
+					"notify": {
+						"billing",
+						"admin",
+					},
 				},
 			},
 		},
-	}, transport, database)
-	orchestrator.Run(cubequeue.RoutingTable{
+	}, transport, database, cubequeue.GetDefaultTransactionOrchestratorSettings())
+	orchestrator.Run(context.Background(), cubequeue.RoutingTable{
 		"account.create": cubequeue.GetDefaultRoutingHandler(),
-		"card.added": func(message amqp.Delivery) error {
+		"card.added": func(message cubequeue.Message) error {
 			logrus.Info("A new card was added")
 			return nil
 		},
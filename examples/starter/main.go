@@ -7,7 +7,10 @@ You can configure as many transaction types
 The custom-handler example demonstrates how to override the default handler with custom logic
 */
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/paladium/cubequeue"
 	"github.com/paladium/cubequeue/databases"
@@ -24,6 +27,18 @@ func setLogging() {
 	logrus.SetLevel(logrus.DebugLevel)
 }
 
+// Cancel the context on SIGINT or SIGTERM, so the running messages are finished before exiting
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	return ctx
+}
+
 func main() {
 	queue := "cubequeue"
 	//Setup the logging
@@ -61,8 +76,8 @@ func main() {
 				},
 			},
 		},
-	}, transport, database)
-	orchestrator.Run(cubequeue.RoutingTable{
+	}, transport, database, cubequeue.GetDefaultTransactionOrchestratorSettings())
+	orchestrator.Run(shutdownContext(), cubequeue.RoutingTable{
 		"account.create": cubequeue.GetDefaultRoutingHandler(),
 	}, cubequeue.GetDefaultSubscribeSettings(queue))
 }
@@ -3,9 +3,12 @@ module github.com/paladium/cubequeue
 go 1.14
 
 require (
+	github.com/lib/pq v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/streadway/amqp v1.0.0
 	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.4.3
 )
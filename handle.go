@@ -0,0 +1,65 @@
+package cubequeue
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/pkg/errors"
+)
+
+// StartTransactionOptions stores optional settings for starting a new transaction
+type StartTransactionOptions struct {
+	// ID of the transaction, a new one is generated if it is empty
+	ID string
+	// Headers are added to the message that starts the transaction
+	Headers map[string]interface{}
+}
+
+// TransactionHandle refers to the started transaction and allows to check its status
+type TransactionHandle struct {
+	ID       string
+	Type     string
+	database ITransactionDatabase
+}
+
+// NewTransactionHandle inits the handle for the transaction stored in a given database
+func NewTransactionHandle(id string, transactionType string, database ITransactionDatabase) *TransactionHandle {
+	return &TransactionHandle{
+		ID:       id,
+		Type:     transactionType,
+		database: database,
+	}
+}
+
+// Find returns the current state of the transaction
+func (handle *TransactionHandle) Find(ctx context.Context) (*models.TransactionModel, error) {
+	return handle.database.Find(ctx, handle.ID)
+}
+
+// Status returns the current status of the transaction
+func (handle *TransactionHandle) Status(ctx context.Context) (models.TransactionStatus, error) {
+	transaction, err := handle.Find(ctx)
+	if err != nil {
+		return "", err
+	}
+	return transaction.Status, nil
+}
+
+// NewTransactionID generates a new random id (uuid v4) for the transaction
+func NewTransactionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot generate the transaction id")
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// NewMessageID generates a new random id (uuid v4) for the message
+func NewMessageID() (string, error) {
+	return NewTransactionID()
+}
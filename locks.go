@@ -0,0 +1,46 @@
+package cubequeue
+
+import "sync"
+
+// Mutex per transaction, so the different transactions can be changed at the same time
+// The entries are removed once nobody holds or waits for them
+type transactionLocks struct {
+	lock  sync.Mutex
+	locks map[string]*transactionLock
+}
+
+type transactionLock struct {
+	sync.Mutex
+	references int
+}
+
+func newTransactionLocks() *transactionLocks {
+	return &transactionLocks{
+		locks: map[string]*transactionLock{},
+	}
+}
+
+// Lock the transaction with the given id
+func (locks *transactionLocks) Lock(id string) {
+	locks.lock.Lock()
+	lock, ok := locks.locks[id]
+	if !ok {
+		lock = &transactionLock{}
+		locks.locks[id] = lock
+	}
+	lock.references++
+	locks.lock.Unlock()
+	lock.Lock()
+}
+
+// Unlock the transaction with the given id
+func (locks *transactionLocks) Unlock(id string) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	lock := locks.locks[id]
+	lock.references--
+	if lock.references == 0 {
+		delete(locks.locks, id)
+	}
+	lock.Unlock()
+}
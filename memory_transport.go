@@ -0,0 +1,146 @@
+package cubequeue
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBroker keeps the queues of the in-memory transports, the transports sharing the broker can send messages to each other
+type MemoryBroker struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]Message
+}
+
+// NewMemoryBroker inits an empty broker
+func NewMemoryBroker() *MemoryBroker {
+	broker := &MemoryBroker{
+		queues: map[string][]Message{},
+	}
+	broker.cond = sync.NewCond(&broker.lock)
+	return broker
+}
+
+func (broker *MemoryBroker) push(queue string, message Message) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.queues[queue] = append(broker.queues[queue], message)
+	broker.cond.Broadcast()
+}
+
+// Wait for the next message in the queue, false is returned once the transport is closed or the context is cancelled
+func (broker *MemoryBroker) pop(ctx context.Context, queue string, transport *TransactionMemoryTransport) (Message, bool) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	for len(broker.queues[queue]) == 0 && !transport.closed && ctx.Err() == nil {
+		broker.cond.Wait()
+	}
+	if transport.closed || ctx.Err() != nil {
+		return Message{}, false
+	}
+	message := broker.queues[queue][0]
+	broker.queues[queue] = broker.queues[queue][1:]
+	return message, true
+}
+
+// Pending returns the messages waiting in the queue, useful for testing
+func (broker *MemoryBroker) Pending(queue string) []Message {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	messages := make([]Message, len(broker.queues[queue]))
+	copy(messages, broker.queues[queue])
+	return messages
+}
+
+// TransactionMemoryTransport implementation of ITransactionTransport that delivers the messages within the process
+// It allows running the orchestrator and the services in one process or in the unit tests without the message broker
+type TransactionMemoryTransport struct {
+	broker *MemoryBroker
+	closed bool
+}
+
+// NewTransactionMemoryTransport creates a new transport on top of a given broker
+func NewTransactionMemoryTransport(broker *MemoryBroker) *TransactionMemoryTransport {
+	return &TransactionMemoryTransport{
+		broker: broker,
+	}
+}
+
+// Publish a message to a given queue
+func (transport *TransactionMemoryTransport) Publish(queue string, message Message) error {
+	transport.broker.push(queue, message)
+	return nil
+}
+
+// Subscribe for messages in the queue given in the settings, blocks until the transport is closed or the context is cancelled
+// The messages are handled by Concurrency goroutines, the messages of one transaction are handled in order by the same goroutine
+func (transport *TransactionMemoryTransport) Subscribe(ctx context.Context, routingTable RoutingTable, settings SubscribeSettings) error {
+	pool := newPartitionedPool(settings.Concurrency)
+	defer pool.close()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			//Wake up the waiting pop
+			transport.broker.lock.Lock()
+			transport.broker.cond.Broadcast()
+			transport.broker.lock.Unlock()
+		case <-stopped:
+		}
+	}()
+	for {
+		message, ok := transport.broker.pop(ctx, settings.Queue, transport)
+		if !ok {
+			return nil
+		}
+		pool.submit(message.CorrelationID, func() {
+			err := routingTable.handle(message)
+			if err == nil {
+				return
+			}
+			if !settings.AutoAck && message.Redeliveries < settings.MaxRedeliveries {
+				//Requeue the failed message the same way the broker does
+				message.Redeliveries++
+				transport.broker.push(settings.Queue, message)
+				return
+			}
+			if settings.DeadLetterQueue != "" {
+				transport.broker.push(settings.DeadLetterQueue, deadLetter(message, settings.Queue, err))
+			}
+		})
+	}
+}
+
+// Reinject moves up to limit messages from the dead-letter queue back to the queues they failed in, zero limit moves all of them
+// The messages without the original queue are left in the dead-letter queue
+func (transport *TransactionMemoryTransport) Reinject(deadLetterQueue string, limit int) (int, error) {
+	transport.broker.lock.Lock()
+	defer transport.broker.lock.Unlock()
+	count := 0
+	kept := []Message{}
+	for _, message := range transport.broker.queues[deadLetterQueue] {
+		if limit > 0 && count >= limit {
+			kept = append(kept, message)
+			continue
+		}
+		queue, reinjected, err := reinjectedMessage(message)
+		if err != nil {
+			kept = append(kept, message)
+			continue
+		}
+		transport.broker.queues[queue] = append(transport.broker.queues[queue], reinjected)
+		count++
+	}
+	transport.broker.queues[deadLetterQueue] = kept
+	transport.broker.cond.Broadcast()
+	return count, nil
+}
+
+// Close stops all the subscriptions of the transport
+func (transport *TransactionMemoryTransport) Close() {
+	transport.broker.lock.Lock()
+	defer transport.broker.lock.Unlock()
+	transport.closed = true
+	transport.broker.cond.Broadcast()
+}
@@ -0,0 +1,230 @@
+package cubequeue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanPublishToMemoryTransport(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	defer transport.Close()
+	err := transport.Publish("cube-backend", Message{
+		CorrelationID: "1",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+	})
+	assert.Nil(t, err)
+	pending := broker.Pending("cube-backend")
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "1", pending[0].CorrelationID)
+	assert.Empty(t, broker.Pending("cube-billing"))
+}
+
+func TestCanSubscribeToMemoryTransport(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	received := make(chan Message, 2)
+	done := make(chan error)
+	go func() {
+		done <- transport.Subscribe(context.Background(), RoutingTable{
+			"invoice.create": func(message Message) error {
+				received <- message
+				return nil
+			},
+			NoHandlerMessage: func(message Message) error {
+				received <- message
+				return nil
+			},
+		}, GetDefaultSubscribeSettings("cubequeue"))
+	}()
+	//The messages published by another transport on the same broker are delivered in order
+	publisher := NewTransactionMemoryTransport(broker)
+	assert.Nil(t, publisher.Publish("cubequeue", Message{CorrelationID: "1", Type: "invoice.create"}))
+	assert.Nil(t, publisher.Publish("cubequeue", Message{CorrelationID: "2", Type: "unknown"}))
+	for _, id := range []string{"1", "2"} {
+		select {
+		case message := <-received:
+			assert.Equal(t, id, message.CorrelationID)
+		case <-time.After(time.Second):
+			t.Fatal("The message was not delivered")
+		}
+	}
+	transport.Close()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe did not return after close")
+	}
+}
+
+func TestCanRequeueFailedMessageInMemoryTransport(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	settings := GetDefaultSubscribeSettings("cubequeue")
+	settings.AutoAck = false
+	settings.MaxRedeliveries = 2
+	deliveries := make(chan int, 5)
+	go transport.Subscribe(context.Background(), RoutingTable{
+		"invoice.create": func(message Message) error {
+			deliveries <- message.Redeliveries
+			return errors.New("Cannot process the message")
+		},
+	}, settings)
+	defer transport.Close()
+	assert.Nil(t, transport.Publish("cubequeue", Message{CorrelationID: "1", Type: "invoice.create"}))
+	//The message is delivered once and requeued twice, then dropped
+	for _, redeliveries := range []int{0, 1, 2} {
+		select {
+		case delivered := <-deliveries:
+			assert.Equal(t, redeliveries, delivered)
+		case <-time.After(time.Second):
+			t.Fatal("The message was not delivered")
+		}
+	}
+	select {
+	case <-deliveries:
+		t.Fatal("The message was delivered after running out of redeliveries")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Empty(t, broker.Pending("cubequeue"))
+}
+
+func TestCanDeadLetterFailedMessageInMemoryTransport(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	settings := GetDefaultSubscribeSettings("cubequeue")
+	settings.DeadLetterQueue = "cubequeue-dead"
+	processed := make(chan Message, 2)
+	go transport.Subscribe(context.Background(), RoutingTable{
+		"invoice.create": func(message Message) error {
+			processed <- message
+			return nil
+		},
+	}, settings)
+	defer transport.Close()
+	//There is neither a handler for the type nor the no_handler route
+	assert.Nil(t, transport.Publish("cubequeue", Message{CorrelationID: "1", Type: "invoice.created"}))
+	deadline := time.Now().Add(time.Second)
+	for len(broker.Pending("cubequeue-dead")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadLetters := broker.Pending("cubequeue-dead")
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, "cubequeue", deadLetters[0].Headers[DeadLetterQueueHeader])
+	assert.Equal(t, "No handler for the message type invoice.created", deadLetters[0].Headers[DeadLetterErrorHeader])
+	assert.NotNil(t, deadLetters[0].Headers[DeadLetterDateHeader])
+
+	//Once the cause is fixed the message is re-injected into the original queue
+	broker.lock.Lock()
+	broker.queues["cubequeue-dead"][0].Type = "invoice.create"
+	broker.lock.Unlock()
+	count, err := transport.Reinject("cubequeue-dead", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Empty(t, broker.Pending("cubequeue-dead"))
+	select {
+	case message := <-processed:
+		assert.Equal(t, "1", message.CorrelationID)
+		assert.Nil(t, message.Headers[DeadLetterErrorHeader])
+		assert.Nil(t, message.Headers[DeadLetterQueueHeader])
+	case <-time.After(time.Second):
+		t.Fatal("The message was not re-injected")
+	}
+}
+
+func TestCanRecoverFromPanickingHandler(t *testing.T) {
+	err := RoutingTable{
+		"invoice.create": func(message Message) error {
+			var payload map[string]interface{}
+			payload["invoiceNumber"] = "34555678"
+			return nil
+		},
+	}.route(Message{CorrelationID: "1", Type: "invoice.create"})
+	assert.NotNil(t, err)
+}
+
+func TestCanProcessMessagesConcurrentlyInMemoryTransport(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	settings := GetDefaultSubscribeSettings("cubequeue")
+	settings.Concurrency = 4
+	var lock sync.Mutex
+	received := map[string][]int{}
+	done := make(chan struct{}, 60)
+	go transport.Subscribe(context.Background(), RoutingTable{
+		"invoice.create": func(message Message) error {
+			lock.Lock()
+			received[message.CorrelationID] = append(received[message.CorrelationID], message.Headers["sequence"].(int))
+			lock.Unlock()
+			done <- struct{}{}
+			return nil
+		},
+	}, settings)
+	defer transport.Close()
+	for sequence := 0; sequence < 20; sequence++ {
+		for _, id := range []string{"1", "2", "3"} {
+			transport.Publish("cubequeue", Message{
+				CorrelationID: id,
+				Type:          "invoice.create",
+				Headers: map[string]interface{}{
+					"sequence": sequence,
+				},
+			})
+		}
+	}
+	for i := 0; i < 60; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("The messages were not delivered")
+		}
+	}
+	//The messages of every transaction are handled in the order they were published
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Len(t, received[id], 20)
+		for sequence, value := range received[id] {
+			assert.Equal(t, sequence, value)
+		}
+	}
+}
+
+func TestCanDrainMemoryTransportOnCancel(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	defer transport.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	finished := false
+	done := make(chan error)
+	go func() {
+		done <- transport.Subscribe(ctx, RoutingTable{
+			"invoice.create": func(message Message) error {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				finished = true
+				return nil
+			},
+		}, GetDefaultSubscribeSettings("cubequeue"))
+	}()
+	transport.Publish("cubequeue", Message{CorrelationID: "1", Type: "invoice.create"})
+	<-started
+	cancel()
+	//Subscribe returns only after the message being handled is finished
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+		assert.True(t, finished)
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe did not return after cancel")
+	}
+	//The messages published afterwards are left in the queue
+	transport.Publish("cubequeue", Message{CorrelationID: "2", Type: "invoice.create"})
+	assert.Len(t, broker.Pending("cubequeue"), 1)
+}
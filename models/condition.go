@@ -0,0 +1,168 @@
+package models
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StagePredicate decides whether the stage should run for a given transaction payload
+type StagePredicate func(payload map[string]interface{}) bool
+
+// EvaluateCondition evaluates a simple condition against the transaction payload
+// The condition consists of the terms joined with && and ||, where each term is one of:
+// field - the field is present and not empty, !field - the field is missing or empty,
+// field == value and field != value - the value is a quoted string, a number, true, false or null
+// Nested fields are separated by dots, for example customer.country == "DE"
+// The operators inside the quoted strings are part of the value, for example filename == "a&&b"
+func EvaluateCondition(condition string, payload map[string]interface{}) (bool, error) {
+	result := false
+	for _, alternative := range splitOutsideQuotes(condition, "||") {
+		matched := true
+		for _, term := range splitOutsideQuotes(alternative, "&&") {
+			termResult, err := evaluateTerm(strings.TrimSpace(term), payload)
+			if err != nil {
+				return false, errors.Wrapf(err, "Cannot evaluate the condition %s", condition)
+			}
+			//Every term is evaluated, so the invalid condition is never hidden by the short circuit
+			matched = matched && termResult
+		}
+		result = result || matched
+	}
+	return result, nil
+}
+
+func evaluateTerm(term string, payload map[string]interface{}) (bool, error) {
+	if term == "" {
+		return false, errors.New("Empty term")
+	}
+	for _, operator := range []string{"==", "!="} {
+		position := indexOutsideQuotes(term, operator)
+		if position == -1 {
+			continue
+		}
+		value := lookupField(payload, strings.TrimSpace(term[:position]))
+		expected, err := parseLiteral(strings.TrimSpace(term[position+len(operator):]))
+		if err != nil {
+			return false, err
+		}
+		equal := valuesEqual(value, expected)
+		if operator == "!=" {
+			return !equal, nil
+		}
+		return equal, nil
+	}
+	if strings.HasPrefix(term, "!") {
+		return !truthy(lookupField(payload, strings.TrimSpace(term[1:]))), nil
+	}
+	return truthy(lookupField(payload, term)), nil
+}
+
+// Find the first occurrence of the separator that is not inside a quoted string, -1 is returned if there is none
+func indexOutsideQuotes(text string, separator string) int {
+	var quote byte
+	for position := 0; position < len(text); position++ {
+		switch {
+		case quote != 0:
+			if text[position] == quote {
+				quote = 0
+			}
+		case text[position] == '"' || text[position] == '\'':
+			quote = text[position]
+		case strings.HasPrefix(text[position:], separator):
+			return position
+		}
+	}
+	return -1
+}
+
+// Split the text around the separators that are not inside quoted strings
+func splitOutsideQuotes(text string, separator string) []string {
+	parts := []string{}
+	for {
+		position := indexOutsideQuotes(text, separator)
+		if position == -1 {
+			return append(parts, text)
+		}
+		parts = append(parts, text[:position])
+		text = text[position+len(separator):]
+	}
+}
+
+// Find the value of a possibly nested field, nil is returned if the field is missing
+func lookupField(payload map[string]interface{}, field string) interface{} {
+	var value interface{} = payload
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+func parseLiteral(literal string) (interface{}, error) {
+	if len(literal) >= 2 && (literal[0] == '"' || literal[0] == '\'') && literal[len(literal)-1] == literal[0] {
+		return literal[1 : len(literal)-1], nil
+	}
+	switch literal {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, errors.Errorf("Cannot parse the value %s", literal)
+	}
+	return number, nil
+}
+
+// The payload decoded from json has float64 numbers, while the one built in code can have any integer type
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+func valuesEqual(value interface{}, expected interface{}) bool {
+	if expectedNumber, ok := toFloat(expected); ok {
+		number, ok := toFloat(value)
+		return ok && number == expectedNumber
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+func truthy(value interface{}) bool {
+	if number, ok := toFloat(value); ok {
+		return number != 0
+	}
+	switch typed := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typed
+	case string:
+		return typed != ""
+	case map[string]interface{}:
+		return len(typed) > 0
+	case []interface{}:
+		return len(typed) > 0
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanEvaluateCondition(t *testing.T) {
+	payload := map[string]interface{}{
+		"invoiceNumber": "34555678",
+		"filename":      "invoice-34555678.pdf",
+		"title":         "a&&b || c",
+		"amount":        56.67,
+		"paid":          false,
+		"customer": map[string]interface{}{
+			"country": "DE",
+		},
+	}
+	for condition, expected := range map[string]bool{
+		"filename":                   true,
+		"!filename":                  false,
+		"attachment":                 false,
+		"!attachment":                true,
+		"paid":                       false,
+		"amount == 56.67":            true,
+		"amount != 56.67":            false,
+		"customer.country == \"DE\"": true,
+		"customer.country == 'FR'":   false,
+		"customer.city == null":      true,
+		"filename && paid == false":  true,
+		"attachment || customer.country == \"DE\"": true,
+		"attachment || paid":                       false,
+		"title == \"a&&b || c\"":                   true,
+		"title != 'a == b' && title":               true,
+		"title == \"a\" || title == 'b'":           false,
+	} {
+		result, err := EvaluateCondition(condition, payload)
+		assert.Nil(t, err, condition)
+		assert.Equal(t, expected, result, condition)
+	}
+}
+
+func TestCannotEvaluateInvalidCondition(t *testing.T) {
+	_, err := EvaluateCondition("amount == fifty", map[string]interface{}{})
+	assert.NotNil(t, err)
+	_, err = EvaluateCondition("filename && ", map[string]interface{}{})
+	assert.NotNil(t, err)
+}
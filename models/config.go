@@ -1,6 +1,12 @@
 package models
 
-import "github.com/pkg/errors"
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // TransactionService stores one of the services that messages could be delivered to
 type TransactionService struct {
@@ -9,16 +15,115 @@ type TransactionService struct {
 	Name        string
 }
 
+// DefaultCompensationAttempts is used when the transaction does not specify how many times the rollback should be tried
+const DefaultCompensationAttempts = 3
+
+// DefaultCompensationTimeout is used when the transaction does not specify how long the service has to answer the rollback message
+const DefaultCompensationTimeout = time.Minute
+
+// RollbackStrategy defines in which order the stages of the failed transaction are compensated
+type RollbackStrategy string
+
+// Available rollback strategies, parallel is used by default
+const (
+	// RollbackParallel sends the rollback message to all the previous stages at once
+	RollbackParallel RollbackStrategy = "parallel"
+	// RollbackReverseSequential compensates the stages one by one starting from the latest one, waiting for the ack of each compensation
+	RollbackReverseSequential RollbackStrategy = "reverse_sequential"
+)
+
+// RetryPolicy defines how the failed stage is sent to its service again before the transaction is rolled back
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one, zero or one disables the retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential growth of the backoff, zero means no cap
+	MaxBackoff time.Duration
+	// Multiplier is applied to the backoff after each attempt, 2 is used if not set
+	Multiplier float64
+	// Jitter randomizes the backoff by up to the given fraction of it in both directions, for example 0.2 means +-20%
+	Jitter float64
+}
+
+// Backoff returns how long to wait after a given failed attempt (starting from 1) before sending the next one
+func (policy RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		backoff += backoff * policy.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// TransactionStageSettings stores optional settings for one of the stages of the transaction
+type TransactionStageSettings struct {
+	// Timeout is how long the service has to answer, zero means the orchestrator waits forever
+	Timeout time.Duration
+	Retry   RetryPolicy
+	// Condition is evaluated against the payload when the stage is reached, the stage is skipped if it is false, see EvaluateCondition
+	Condition string
+	// Predicate is the name of the predicate in TransactionConfig.Predicates, the stage is skipped if it returns false
+	Predicate string
+}
+
 // Transaction is a single transaction that has a number of stages it has to go through
 type Transaction struct {
 	Description string
 	Stages      []string
+	// Groups stores the services that run in parallel by the group name, the group name can be used in the stages like a service
+	Groups map[string][]string
+	// StageSettings stores settings of the stages by the service or group name, stages without settings use the defaults
+	StageSettings map[string]TransactionStageSettings
+	// CompensationAttempts is the maximum number of rollback messages sent to a stage before giving up on it
+	CompensationAttempts int
+	// CompensationTimeout is how long the service has to answer the rollback message, the unanswered message counts as a failed attempt
+	CompensationTimeout time.Duration
+	RollbackStrategy    RollbackStrategy
+	// PayloadMerge defines how the payload sent back by the services is merged into the transaction payload
+	PayloadMerge PayloadMergeStrategy
+}
+
+// Settings returns the settings of the stage handled by a given service or group
+func (transaction Transaction) Settings(name string) TransactionStageSettings {
+	return transaction.StageSettings[name]
+}
+
+// ServiceSettings returns the settings of the stage handled by a given service, the settings of its group are used if the service has none
+func (transaction Transaction) ServiceSettings(service string, group string) TransactionStageSettings {
+	if settings, ok := transaction.StageSettings[service]; ok || group == "" {
+		return settings
+	}
+	return transaction.StageSettings[group]
+}
+
+// MaxCompensationAttempts returns the number of times each stage should be asked to roll back
+func (transaction Transaction) MaxCompensationAttempts() int {
+	if transaction.CompensationAttempts <= 0 {
+		return DefaultCompensationAttempts
+	}
+	return transaction.CompensationAttempts
+}
+
+// GetCompensationTimeout returns how long to wait for the answer to the rollback message
+func (transaction Transaction) GetCompensationTimeout() time.Duration {
+	if transaction.CompensationTimeout <= 0 {
+		return DefaultCompensationTimeout
+	}
+	return transaction.CompensationTimeout
 }
 
 // TransactionConfig stores the current available services & transactions
 type TransactionConfig struct {
 	Services     map[string]TransactionService
 	Transactions map[string]Transaction
+	// Predicates stores the go functions that can be used as stage conditions by their name
+	Predicates map[string]StagePredicate
 }
 
 // FindServiceByName finds the service by its name
@@ -29,28 +134,84 @@ func (transactionConfig TransactionConfig) FindServiceByName(name string) (*Tran
 	return nil, errors.New("Service cannot be found")
 }
 
-// TransactionChain contains each service one by one resolved from a particular transaction type (we only have the names of the services)
-type TransactionChain []TransactionService
+// ErrNoMoreSteps is returned by the chain when the transaction went through all of its stages
+var ErrNoMoreSteps = errors.New("No more steps")
 
-// NextService returns the next service to be handled in a transaction
-func (chain TransactionChain) NextService(transaction *TransactionModel) (*TransactionService, error) {
-	latestIndex := len(transaction.Stages) - 1
-	index := latestIndex + 1
-	if index > len(chain)-1 {
-		return nil, errors.New("No more steps")
+// TransactionChainStep is a single step of the transaction, either one service or a group of services running in parallel
+type TransactionChainStep struct {
+	Index int
+	Name  string
+	// Group is the name of the group if the services of the step run in parallel, empty otherwise
+	Group     string
+	Services  []TransactionService
+	Condition string
+	Predicate StagePredicate
+}
+
+// Applies returns whether the step should run for a given payload
+func (step TransactionChainStep) Applies(payload map[string]interface{}) (bool, error) {
+	if step.Predicate != nil && !step.Predicate(payload) {
+		return false, nil
+	}
+	if step.Condition == "" {
+		return true, nil
 	}
-	return &chain[index], nil
+	return EvaluateCondition(step.Condition, payload)
+}
+
+// TransactionChain contains each step one by one resolved from a particular transaction type (we only have the names of the services)
+type TransactionChain []TransactionChainStep
+
+// NextStep returns the next step to be handled in a transaction along with the steps skipped because of their conditions
+// ErrNoMoreSteps is returned if there are no steps left to run, the skipped steps are still returned in that case
+func (chain TransactionChain) NextStep(transaction *TransactionModel) (*TransactionChainStep, []TransactionChainStep, error) {
+	skipped := []TransactionChainStep{}
+	for index := transaction.CurrentStep() + 1; index < len(chain); index++ {
+		applies, err := chain[index].Applies(transaction.Payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		if applies {
+			return &chain[index], skipped, nil
+		}
+		skipped = append(skipped, chain[index])
+	}
+	return nil, skipped, ErrNoMoreSteps
 }
 
 // NewTransactionChain makes a new transaction chain based on a particular transaction`s config
 func NewTransactionChain(transactionConfig TransactionConfig, transaction Transaction) (TransactionChain, error) {
-	chain := []TransactionService{}
-	for _, stage := range transaction.Stages {
-		service, err := transactionConfig.FindServiceByName(stage)
-		if err != nil {
-			return nil, errors.Errorf("Cannot find a service by its name %s", stage)
+	chain := []TransactionChainStep{}
+	for index, stage := range transaction.Stages {
+		settings := transaction.Settings(stage)
+		step := TransactionChainStep{
+			Index:     index,
+			Name:      stage,
+			Condition: settings.Condition,
+		}
+		serviceNames := []string{stage}
+		if group, ok := transaction.Groups[stage]; ok {
+			if len(group) == 0 {
+				return nil, errors.Errorf("The group %s has no services", stage)
+			}
+			serviceNames = group
+			step.Group = stage
+		}
+		if settings.Predicate != "" {
+			predicate, ok := transactionConfig.Predicates[settings.Predicate]
+			if !ok {
+				return nil, errors.Errorf("Cannot find a predicate by its name %s", settings.Predicate)
+			}
+			step.Predicate = predicate
+		}
+		for _, serviceName := range serviceNames {
+			service, err := transactionConfig.FindServiceByName(serviceName)
+			if err != nil {
+				return nil, errors.Errorf("Cannot find a service by its name %s", serviceName)
+			}
+			step.Services = append(step.Services, *service)
 		}
-		chain = append(chain, *service)
+		chain = append(chain, step)
 	}
 	return chain, nil
 }
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanCalculateBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 5*time.Second, policy.Backoff(4))
+}
+
+func TestCanAddJitterToBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		Multiplier:     3,
+		Jitter:         0.5,
+	}
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert.True(t, backoff >= 1500*time.Millisecond)
+		assert.True(t, backoff <= 4500*time.Millisecond)
+	}
+}
+
+func TestCanResolveParallelGroups(t *testing.T) {
+	transactionConfig := TransactionConfig{
+		Services: map[string]TransactionService{
+			"backend": {Name: "backend", Queue: "cube-backend"},
+			"billing": {Name: "billing", Queue: "cube-billing"},
+			"admin":   {Name: "admin", Queue: "cube-admin"},
+		},
+	}
+	chain, err := NewTransactionChain(transactionConfig, Transaction{
+		Stages: []string{"backend", "notify"},
+		Groups: map[string][]string{
+			"notify": {"billing", "admin"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, chain, 2)
+	step, _, err := chain.NextStep(&TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "notify", step.Name)
+	assert.Equal(t, "notify", step.Group)
+	assert.Len(t, step.Services, 2)
+	assert.Equal(t, "billing", step.Services[0].Name)
+	assert.Equal(t, "admin", step.Services[1].Name)
+	_, _, err = chain.NextStep(&TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+			{Order: 1, Step: 1, Service: "billing", Ack: true},
+			{Order: 2, Step: 1, Service: "admin", Ack: true},
+		},
+	})
+	assert.Equal(t, ErrNoMoreSteps, err)
+}
+
+func TestCanSkipStagesByCondition(t *testing.T) {
+	transactionConfig := TransactionConfig{
+		Services: map[string]TransactionService{
+			"backend":         {Name: "backend", Queue: "cube-backend"},
+			"image-processor": {Name: "image-processor", Queue: "cube-image-processor"},
+			"billing":         {Name: "billing", Queue: "cube-billing"},
+		},
+		Predicates: map[string]StagePredicate{
+			"paid": func(payload map[string]interface{}) bool {
+				return payload["paid"] == true
+			},
+		},
+	}
+	chain, err := NewTransactionChain(transactionConfig, Transaction{
+		Stages: []string{"backend", "image-processor", "billing"},
+		StageSettings: map[string]TransactionStageSettings{
+			"image-processor": {Condition: "filename"},
+			"billing":         {Predicate: "paid"},
+		},
+	})
+	assert.Nil(t, err)
+	transaction := &TransactionModel{
+		Payload: map[string]interface{}{
+			"invoiceNumber": "34555678",
+			"paid":          true,
+		},
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+		},
+	}
+	step, skipped, err := chain.NextStep(transaction)
+	assert.Nil(t, err)
+	assert.Equal(t, "billing", step.Name)
+	assert.Equal(t, 2, step.Index)
+	assert.Len(t, skipped, 1)
+	assert.Equal(t, "image-processor", skipped[0].Name)
+	transaction.Payload["paid"] = false
+	_, skipped, err = chain.NextStep(transaction)
+	assert.Equal(t, ErrNoMoreSteps, err)
+	assert.Len(t, skipped, 2)
+
+	_, err = NewTransactionChain(transactionConfig, Transaction{
+		Stages: []string{"backend", "billing"},
+		StageSettings: map[string]TransactionStageSettings{
+			"billing": {Predicate: "unknown"},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCanFallBackToGroupSettings(t *testing.T) {
+	transaction := Transaction{
+		StageSettings: map[string]TransactionStageSettings{
+			"notify":  {Timeout: time.Minute},
+			"billing": {Timeout: time.Second},
+		},
+	}
+	assert.Equal(t, time.Second, transaction.ServiceSettings("billing", "notify").Timeout)
+	assert.Equal(t, time.Minute, transaction.ServiceSettings("admin", "notify").Timeout)
+	assert.Equal(t, time.Duration(0), transaction.ServiceSettings("admin", "").Timeout)
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"reflect"
+	"sort"
+)
+
+// PayloadMergeStrategy defines how the payload sent back by the service is merged into the transaction payload
+type PayloadMergeStrategy string
+
+// Available merge strategies, merge patch is used by default
+const (
+	// PayloadMergePatch applies the payload of the service as json merge patch (RFC 7396), null values remove the keys
+	PayloadMergePatch PayloadMergeStrategy = "merge_patch"
+	// PayloadReplace replaces the whole transaction payload with the payload of the service
+	PayloadReplace PayloadMergeStrategy = "replace"
+	// PayloadNamespaced stores the keys added or changed by the service under the service name, the rest of the payload is left as is
+	PayloadNamespaced PayloadMergeStrategy = "namespaced"
+)
+
+// MergePayload merges the output of the service into the payload using a given strategy
+// The merged payload is returned along with the keys that were changed, nested keys are separated by dots
+func MergePayload(strategy PayloadMergeStrategy, payload map[string]interface{}, output map[string]interface{}, service string) (map[string]interface{}, []string) {
+	var merged map[string]interface{}
+	switch strategy {
+	case PayloadReplace:
+		merged = copyPayload(output)
+	case PayloadNamespaced:
+		merged = copyPayload(payload)
+		namespace := map[string]interface{}{}
+		if existing, ok := payload[service].(map[string]interface{}); ok {
+			namespace = copyPayload(existing)
+		}
+		for key, value := range output {
+			if key == service {
+				continue
+			}
+			if previous, ok := payload[key]; !ok || !reflect.DeepEqual(previous, value) {
+				namespace[key] = value
+			}
+		}
+		if len(namespace) > 0 {
+			merged[service] = namespace
+		}
+	default:
+		merged = mergePatch(payload, output)
+	}
+	changedKeys := diffPayload(payload, merged, "")
+	sort.Strings(changedKeys)
+	return merged, changedKeys
+}
+
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	merged := copyPayload(target)
+	for key, value := range patch {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		patchObject, ok := value.(map[string]interface{})
+		if !ok {
+			merged[key] = value
+			continue
+		}
+		targetObject, _ := merged[key].(map[string]interface{})
+		merged[key] = mergePatch(targetObject, patchObject)
+	}
+	return merged
+}
+
+func copyPayload(payload map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		if object, ok := value.(map[string]interface{}); ok {
+			value = copyPayload(object)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// Find the keys that were added, removed or changed, the objects are compared key by key
+func diffPayload(before map[string]interface{}, after map[string]interface{}, prefix string) []string {
+	changedKeys := []string{}
+	for key, afterValue := range after {
+		beforeValue, ok := before[key]
+		if !ok {
+			changedKeys = append(changedKeys, prefix+key)
+			continue
+		}
+		beforeObject, beforeIsObject := beforeValue.(map[string]interface{})
+		afterObject, afterIsObject := afterValue.(map[string]interface{})
+		if beforeIsObject && afterIsObject {
+			changedKeys = append(changedKeys, diffPayload(beforeObject, afterObject, prefix+key+".")...)
+			continue
+		}
+		if !reflect.DeepEqual(beforeValue, afterValue) {
+			changedKeys = append(changedKeys, prefix+key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changedKeys = append(changedKeys, prefix+key)
+		}
+	}
+	return changedKeys
+}
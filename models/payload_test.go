@@ -0,0 +1,67 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanMergePatchPayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"accountName": "Apple INC",
+		"plan":        "free",
+		"customer": map[string]interface{}{
+			"country": "DE",
+			"city":    "Berlin",
+		},
+	}
+	merged, changedKeys := MergePayload(PayloadMergePatch, payload, map[string]interface{}{
+		"accountId": "2345672",
+		"plan":      nil,
+		"customer": map[string]interface{}{
+			"city": "Munich",
+		},
+	}, "billing")
+	assert.Equal(t, map[string]interface{}{
+		"accountName": "Apple INC",
+		"accountId":   "2345672",
+		"customer": map[string]interface{}{
+			"country": "DE",
+			"city":    "Munich",
+		},
+	}, merged)
+	assert.Equal(t, []string{"accountId", "customer.city", "plan"}, changedKeys)
+	//The original payload is left untouched
+	assert.Equal(t, "free", payload["plan"])
+}
+
+func TestCanReplacePayload(t *testing.T) {
+	merged, changedKeys := MergePayload(PayloadReplace, map[string]interface{}{
+		"accountName": "Apple INC",
+		"plan":        "free",
+	}, map[string]interface{}{
+		"accountName": "Apple INC",
+		"accountId":   "2345672",
+	}, "billing")
+	assert.Equal(t, map[string]interface{}{
+		"accountName": "Apple INC",
+		"accountId":   "2345672",
+	}, merged)
+	assert.Equal(t, []string{"accountId", "plan"}, changedKeys)
+}
+
+func TestCanNamespacePayload(t *testing.T) {
+	merged, changedKeys := MergePayload(PayloadNamespaced, map[string]interface{}{
+		"accountName": "Apple INC",
+	}, map[string]interface{}{
+		"accountName": "Apple INC",
+		"accountId":   "2345672",
+	}, "billing")
+	assert.Equal(t, map[string]interface{}{
+		"accountName": "Apple INC",
+		"billing": map[string]interface{}{
+			"accountId": "2345672",
+		},
+	}, merged)
+	assert.Equal(t, []string{"billing"}, changedKeys)
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"time"
+)
+
+// TransactionSortField is the date the transactions are sorted and paginated by
+type TransactionSortField string
+
+// Possible fields to sort the transactions by
+const (
+	SortByCreatedAt TransactionSortField = "createdat"
+	SortByUpdatedAt TransactionSortField = "updatedat"
+)
+
+// DefaultQueryLimit is the size of the page when the query has no limit
+const DefaultQueryLimit = 100
+
+// TransactionQuery filters the transactions, the empty fields do not filter
+type TransactionQuery struct {
+	Types    []string
+	Statuses []TransactionStatus
+	// Service matches the transactions that have the service in their latest step that was not skipped
+	Service string
+	// HasError matches the transactions that have, or have not, a failed stage
+	HasError *bool
+	// From and To limit the date used for sorting, From is inclusive and To is exclusive
+	From time.Time
+	To   time.Time
+	// SortBy is the date the transactions are sorted by, the transactions with the same date are sorted by id
+	SortBy     TransactionSortField
+	Descending bool
+	Limit      int
+	// Cursor is the NextCursor of the previous page, the empty cursor starts from the first page
+	Cursor string
+}
+
+// TransactionPage is a single page of the query results
+type TransactionPage struct {
+	Transactions []*TransactionModel
+	// NextCursor is empty if there are no more transactions
+	NextCursor string
+}
+
+// GetSortBy returns the field to sort by, the transactions are sorted by the date of creation by default
+func (query *TransactionQuery) GetSortBy() TransactionSortField {
+	if query.SortBy == "" {
+		return SortByCreatedAt
+	}
+	return query.SortBy
+}
+
+// GetLimit returns the size of the page
+func (query *TransactionQuery) GetLimit() int {
+	if query.Limit <= 0 {
+		return DefaultQueryLimit
+	}
+	return query.Limit
+}
+
+// SortDate returns the date of the transaction the query sorts by
+func (query *TransactionQuery) SortDate(transaction *TransactionModel) time.Time {
+	if query.GetSortBy() == SortByUpdatedAt {
+		return transaction.UpdatedAt
+	}
+	return transaction.CreatedAt
+}
+
+// Matches returns true if the transaction passes all the filters of the query
+func (query *TransactionQuery) Matches(transaction *TransactionModel) bool {
+	if len(query.Types) > 0 && !containsString(query.Types, transaction.Type) {
+		return false
+	}
+	if len(query.Statuses) > 0 {
+		found := false
+		for _, status := range query.Statuses {
+			if status == transaction.Status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if query.Service != "" && !containsString(transaction.CurrentServices, query.Service) {
+		return false
+	}
+	if query.HasError != nil && *query.HasError != transaction.HasError() {
+		return false
+	}
+	date := query.SortDate(transaction)
+	if !query.From.IsZero() && date.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !date.Before(query.To) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, current := range values {
+		if current == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// RetentionFilter selects the transactions that were not changed for longer than their retention allows
+type RetentionFilter struct {
+	Status TransactionStatus
+	// Type limits the filter to one transaction type, the empty type matches all the types except ExcludeTypes
+	Type         string
+	ExcludeTypes []string
+	// UpdatedBefore matches the transactions updated before the date, the transactions without the date of the update are never matched
+	UpdatedBefore time.Time
+	Limit         int
+}
+
+// Matches returns true if the transaction is selected by the filter
+func (filter *RetentionFilter) Matches(transaction *TransactionModel) bool {
+	if transaction.Status != filter.Status || transaction.UpdatedAt.IsZero() || !transaction.UpdatedAt.Before(filter.UpdatedBefore) {
+		return false
+	}
+	if filter.Type != "" {
+		return transaction.Type == filter.Type
+	}
+	return !containsString(filter.ExcludeTypes, transaction.Type)
+}
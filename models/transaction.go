@@ -1,23 +1,190 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CompensationStatus describes the state of the rollback for a particular stage
+type CompensationStatus string
+
+// Possible statuses of the stage compensation, empty status means the stage was never asked to roll back
+const (
+	CompensationPending   CompensationStatus = "pending"
+	CompensationCompleted CompensationStatus = "completed"
+	CompensationFailed    CompensationStatus = "failed"
+	// CompensationCancelled is set on the stages that were never asked to roll back, because the compensation before them failed
+	CompensationCancelled CompensationStatus = "cancelled"
+)
+
+// TransactionStageAttemptModel is a single delivery of the stage to its service
+type TransactionStageAttemptModel struct {
+	Date  time.Time
+	Error *string
+}
 
 // TransactionStageModel is individual stage of transaction
 type TransactionStageModel struct {
-	Order   int
-	Service string
+	Order int
+	// Step is the index of the step in the transaction chain, the services running in parallel share the same step
+	Step int
+	// Skipped is set on the stages that did not run, because their condition was false
+	Skipped bool
+	// Group is the name of the group the service runs in, empty if the service is the step on its own
+	Group    string
+	Service  string
+	Queue    string
+	Ack      bool
+	Date     time.Time
+	Deadline *time.Time
+	Error    *string
+	Attempts []TransactionStageAttemptModel
+	// ChangedKeys are the keys of the payload changed by the service when it sent the ack
+	ChangedKeys          []string
+	RetryAt              *time.Time
+	Compensation         CompensationStatus
+	CompensationAttempts int
+	CompensationError    *string
+	// CompensationDeadline is when the rollback message sent last is considered lost, so it is sent again
+	CompensationDeadline *time.Time
+	// CompensationMessage is the id of the rollback message sent last, it is sent again with the same id if its answer was lost
+	// so the service that already compensated the stage only answers again
+	CompensationMessage string
+}
+
+// OutboxMessageModel is a message waiting to be published, it is saved along with the change of the transaction that produced it
+// so the saved state and the published messages cannot diverge
+type OutboxMessageModel struct {
+	ID      string
 	Queue   string
-	Ack     bool
-	Date    time.Time
-	Error   *string
+	Type    string
+	Headers map[string]interface{}
+	Body    []byte
+	// Stage is the order of the stage the message is dispatched to, the stage fails if the message cannot be published
+	Stage *int
+	Date  time.Time
 }
 
+// TransactionStatus describes where the transaction is in its lifecycle
+type TransactionStatus string
+
+// Possible statuses of the transaction
+const (
+	TransactionRunning            TransactionStatus = "running"
+	TransactionCompleted          TransactionStatus = "completed"
+	TransactionFailed             TransactionStatus = "failed"
+	TransactionRollingBack        TransactionStatus = "rolling_back"
+	TransactionRolledBack         TransactionStatus = "rolled_back"
+	TransactionCompensationFailed TransactionStatus = "compensation_failed"
+)
+
 // TransactionModel represents a single transaction that keeps track of its stages
 type TransactionModel struct {
-	ID      string `bson:"_id"`
+	ID string `bson:"_id"`
+	// Version is increased by every update, the update fails if the transaction was changed by someone else since it was loaded
+	Version int
 	Type    string
+	Status  TransactionStatus
 	Payload map[string]interface{}
 	Stages  []TransactionStageModel
+	// Outbox keeps the messages that are not published yet
+	Outbox []OutboxMessageModel
+	// ProcessedMessages keeps the ids of the latest messages that changed the transaction, so their duplicates are ignored
+	ProcessedMessages []string
+	// CreatedAt, UpdatedAt and CurrentServices are set by the database when the transaction is saved, they are kept for the queries
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// CurrentServices are the services of the latest step of the transaction that was not skipped
+	CurrentServices []string
+}
+
+// MaxProcessedMessages is how many ids of the processed messages the transaction keeps, the oldest ones are dropped
+// The duplicates are delivered shortly after the original message, so the older ids are not needed any more
+const MaxProcessedMessages = 100
+
+// ErrTransactionNotFound is returned by the database when the transaction does not exist
+var ErrTransactionNotFound = errors.New("The transaction cannot be found")
+
+// VersionConflictError is returned by the update of the transaction that was changed by someone else since it was loaded
+type VersionConflictError struct {
+	ID      string
+	Version int
+}
+
+func (err *VersionConflictError) Error() string {
+	return fmt.Sprintf("The transaction %s was changed since version %d", err.ID, err.Version)
+}
+
+// IsVersionConflict returns true if the error or its cause is VersionConflictError
+func IsVersionConflict(err error) bool {
+	_, ok := errors.Cause(err).(*VersionConflictError)
+	return ok
+}
+
+// IsProcessed returns true if the message with a given id already changed the transaction
+func (transaction *TransactionModel) IsProcessed(messageID string) bool {
+	if messageID == "" {
+		return false
+	}
+	for _, processed := range transaction.ProcessedMessages {
+		if processed == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkProcessed records the id of the message, it is saved along with the changes the message made
+func (transaction *TransactionModel) MarkProcessed(messageID string) {
+	if messageID == "" || transaction.IsProcessed(messageID) {
+		return
+	}
+	transaction.ProcessedMessages = append(transaction.ProcessedMessages, messageID)
+	if len(transaction.ProcessedMessages) > MaxProcessedMessages {
+		transaction.ProcessedMessages = transaction.ProcessedMessages[len(transaction.ProcessedMessages)-MaxProcessedMessages:]
+	}
+}
+
+// Touch sets the fields kept for the queries, the database calls it before saving the transaction
+func (transaction *TransactionModel) Touch(now time.Time) {
+	if transaction.CreatedAt.IsZero() {
+		transaction.CreatedAt = now
+	}
+	transaction.UpdatedAt = now
+	transaction.CurrentServices = []string{}
+	//The skipped steps never ran, so the transaction that completed with them is still at the step that ran last
+	step := -1
+	for _, stage := range transaction.Stages {
+		if !stage.Skipped && stage.Step > step {
+			step = stage.Step
+		}
+	}
+	for _, stage := range transaction.Stages {
+		if stage.Step == step && !stage.Skipped {
+			transaction.CurrentServices = append(transaction.CurrentServices, stage.Service)
+		}
+	}
+}
+
+// HasError returns true if any of the stages failed
+func (transaction *TransactionModel) HasError() bool {
+	for _, stage := range transaction.Stages {
+		if stage.Error != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinished returns true if the transaction reached one of the terminal statuses
+func (transaction *TransactionModel) IsFinished() bool {
+	switch transaction.Status {
+	case TransactionCompleted, TransactionRolledBack, TransactionCompensationFailed:
+		return true
+	}
+	return false
 }
 
 // State returns the latest stage for the transaction
@@ -33,6 +200,72 @@ func (transaction *TransactionModel) State() TransactionStageModel {
 	return latestStage
 }
 
+// FindStage returns the index of the stage with a given order or -1 if there is no such stage
+func (transaction *TransactionModel) FindStage(order int) int {
+	for index, stage := range transaction.Stages {
+		if stage.Order == order {
+			return index
+		}
+	}
+	return -1
+}
+
+// RollbackStatus returns the status of the transaction based on the compensation of its stages
+func (transaction *TransactionModel) RollbackStatus() TransactionStatus {
+	failed := false
+	for _, stage := range transaction.Stages {
+		switch stage.Compensation {
+		case CompensationPending:
+			return TransactionRollingBack
+		case CompensationFailed, CompensationCancelled:
+			failed = true
+		}
+	}
+	if failed {
+		return TransactionCompensationFailed
+	}
+	return TransactionRolledBack
+}
+
+// NextCompensations returns indexes of the pending stages that should receive the rollback message now
+// Stages with no compensation attempts are still waiting for their turn
+func (transaction *TransactionModel) NextCompensations(strategy RollbackStrategy) []int {
+	indexes := []int{}
+	latestIndex := -1
+	for index, stage := range transaction.Stages {
+		if stage.Compensation != CompensationPending {
+			continue
+		}
+		if stage.CompensationAttempts > 0 {
+			//One compensation at a time, wait for the current one to finish
+			if strategy == RollbackReverseSequential {
+				return []int{}
+			}
+			continue
+		}
+		if strategy == RollbackReverseSequential {
+			if latestIndex == -1 || stage.Order > transaction.Stages[latestIndex].Order {
+				latestIndex = index
+			}
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	if latestIndex != -1 {
+		return []int{latestIndex}
+	}
+	return indexes
+}
+
+// CancelCompensations cancels all the compensations that have not been sent yet
+func (transaction *TransactionModel) CancelCompensations() {
+	for index, stage := range transaction.Stages {
+		if stage.Compensation == CompensationPending && stage.CompensationAttempts == 0 {
+			transaction.Stages[index].Compensation = CompensationCancelled
+		}
+	}
+}
+
 // StateCompleted returns whether the latest step was completed
 func (transaction *TransactionModel) StateCompleted(service string) bool {
 	state := transaction.State()
@@ -41,8 +274,11 @@ func (transaction *TransactionModel) StateCompleted(service string) bool {
 
 // AddStage adds a stage to the transaction
 func (transaction *TransactionModel) AddStage(stage TransactionStageModel) {
-	//Increment the order variable
-	stage.Order = transaction.State().Order + 1
+	//Increment the order variable, the very first stage has zero order
+	stage.Order = 0
+	if len(transaction.Stages) > 0 {
+		stage.Order = transaction.State().Order + 1
+	}
 	transaction.Stages = append(transaction.Stages, stage)
 }
 
@@ -51,8 +287,7 @@ func (transactionStage *TransactionStageModel) HasError() bool {
 	return transactionStage.Error != nil
 }
 
-// AckLatestStage ack the latest stage
-func (transaction *TransactionModel) AckLatestStage() {
+func (transaction *TransactionModel) latestStageIndex() int {
 	latestStageOrder := 0
 	currentIndex := 0
 	for index, stage := range transaction.Stages {
@@ -61,18 +296,95 @@ func (transaction *TransactionModel) AckLatestStage() {
 			currentIndex = index
 		}
 	}
-	transaction.Stages[currentIndex].Ack = true
+	return currentIndex
+}
+
+// AckLatestStage ack the latest stage
+func (transaction *TransactionModel) AckLatestStage() {
+	transaction.Stages[transaction.latestStageIndex()].Ack = true
 }
 
 // SetErrorLatestStage sets the error on the latest stage
 func (transaction *TransactionModel) SetErrorLatestStage(errorMessage string) {
-	latestStageOrder := 0
-	currentIndex := 0
+	transaction.Stages[transaction.latestStageIndex()].Error = &errorMessage
+}
+
+// CurrentStep returns the latest step the transaction reached
+func (transaction *TransactionModel) CurrentStep() int {
+	currentStep := -1
+	for _, stage := range transaction.Stages {
+		if stage.Step > currentStep {
+			currentStep = stage.Step
+		}
+	}
+	return currentStep
+}
+
+// CurrentStepCompleted returns true if every service of the current step sent the ack without an error
+func (transaction *TransactionModel) CurrentStepCompleted() bool {
+	currentStep := transaction.CurrentStep()
+	for _, stage := range transaction.Stages {
+		if stage.Step == currentStep && (!stage.Ack || stage.HasError()) {
+			return false
+		}
+	}
+	return true
+}
+
+// PendingStage returns the index of the stage the service is working on right now or -1 if there is no such stage
+func (transaction *TransactionModel) PendingStage(service string) int {
 	for index, stage := range transaction.Stages {
-		if stage.Order > latestStageOrder {
-			latestStageOrder = stage.Order
-			currentIndex = index
+		if stage.Service == service && !stage.Ack && !stage.HasError() && stage.RetryAt == nil {
+			return index
+		}
+	}
+	return -1
+}
+
+// FailureError returns the error of the latest failed stage
+func (transaction *TransactionModel) FailureError() string {
+	failedStageOrder := -1
+	failureError := "The transaction failed"
+	for _, stage := range transaction.Stages {
+		if stage.HasError() && stage.Order > failedStageOrder {
+			failedStageOrder = stage.Order
+			failureError = *stage.Error
 		}
 	}
-	transaction.Stages[currentIndex].Error = &errorMessage
+	return failureError
+}
+
+// StartAttempt records a new attempt of the stage, the stage expires after the timeout if it is set
+func (transactionStage *TransactionStageModel) StartAttempt(date time.Time, timeout time.Duration) {
+	transactionStage.Attempts = append(transactionStage.Attempts, TransactionStageAttemptModel{
+		Date: date,
+	})
+	transactionStage.RetryAt = nil
+	transactionStage.Deadline = nil
+	if timeout > 0 {
+		deadline := date.Add(timeout)
+		transactionStage.Deadline = &deadline
+	}
+}
+
+// SetErrorLatestAttempt sets the error on the latest attempt of the stage
+func (transactionStage *TransactionStageModel) SetErrorLatestAttempt(errorMessage string) {
+	if len(transactionStage.Attempts) == 0 {
+		return
+	}
+	transactionStage.Attempts[len(transactionStage.Attempts)-1].Error = &errorMessage
+}
+
+// StartCompensation records a new rollback message sent to the stage, the service has to answer it before the timeout
+func (transactionStage *TransactionStageModel) StartCompensation(date time.Time, timeout time.Duration) {
+	transactionStage.CompensationAttempts++
+	deadline := date.Add(timeout)
+	transactionStage.CompensationDeadline = &deadline
+}
+
+// ScheduleRetry makes the stage wait for the next attempt at a given date
+func (transactionStage *TransactionStageModel) ScheduleRetry(date time.Time) {
+	transactionStage.Ack = false
+	transactionStage.Deadline = nil
+	transactionStage.RetryAt = &date
 }
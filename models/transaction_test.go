@@ -0,0 +1,182 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanCompensateInParallel(t *testing.T) {
+	transaction := TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Service: "backend", Compensation: CompensationPending},
+			{Order: 1, Service: "billing", Compensation: CompensationPending},
+			{Order: 2, Service: "admin"},
+		},
+	}
+	assert.Equal(t, []int{0, 1}, transaction.NextCompensations(RollbackParallel))
+	assert.Equal(t, TransactionRollingBack, transaction.RollbackStatus())
+}
+
+func TestCanCompensateInReverseOrder(t *testing.T) {
+	transaction := TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Service: "backend", Compensation: CompensationPending},
+			{Order: 1, Service: "billing", Compensation: CompensationPending},
+			{Order: 2, Service: "admin"},
+		},
+	}
+	assert.Equal(t, []int{1}, transaction.NextCompensations(RollbackReverseSequential))
+	//Wait for the billing compensation before sending the next one
+	transaction.Stages[1].CompensationAttempts = 1
+	assert.Empty(t, transaction.NextCompensations(RollbackReverseSequential))
+	transaction.Stages[1].Compensation = CompensationCompleted
+	assert.Equal(t, []int{0}, transaction.NextCompensations(RollbackReverseSequential))
+	transaction.Stages[0].CompensationAttempts = 1
+	transaction.Stages[0].Compensation = CompensationCompleted
+	assert.Equal(t, TransactionRolledBack, transaction.RollbackStatus())
+}
+
+func TestCanCancelCompensations(t *testing.T) {
+	transaction := TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Service: "backend", Compensation: CompensationPending},
+			{Order: 1, Service: "billing", Compensation: CompensationFailed, CompensationAttempts: 3},
+			{Order: 2, Service: "admin"},
+		},
+	}
+	transaction.CancelCompensations()
+	assert.Equal(t, CompensationCancelled, transaction.Stages[0].Compensation)
+	assert.Empty(t, transaction.NextCompensations(RollbackReverseSequential))
+	assert.Equal(t, TransactionCompensationFailed, transaction.RollbackStatus())
+}
+
+func TestCanRecordStageAttempts(t *testing.T) {
+	stage := TransactionStageModel{Order: 1, Step: 1, Service: "billing"}
+	now := time.Now()
+	stage.StartAttempt(now, time.Minute)
+	assert.Len(t, stage.Attempts, 1)
+	assert.Equal(t, now.Add(time.Minute), *stage.Deadline)
+	stage.SetErrorLatestAttempt("Billing is not available")
+	stage.ScheduleRetry(now.Add(time.Second))
+	assert.Nil(t, stage.Deadline)
+	assert.Nil(t, stage.Error)
+	assert.Equal(t, "Billing is not available", *stage.Attempts[0].Error)
+	stage.StartAttempt(now.Add(time.Second), 0)
+	assert.Len(t, stage.Attempts, 2)
+	assert.Nil(t, stage.RetryAt)
+	assert.Nil(t, stage.Deadline)
+}
+
+func TestCanWaitForParallelStages(t *testing.T) {
+	transaction := TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+			{Order: 1, Step: 1, Service: "billing", Ack: true},
+			{Order: 2, Step: 1, Service: "admin"},
+		},
+	}
+	assert.Equal(t, 1, transaction.CurrentStep())
+	assert.False(t, transaction.CurrentStepCompleted())
+	assert.Equal(t, -1, transaction.PendingStage("billing"))
+	assert.Equal(t, 2, transaction.PendingStage("admin"))
+	transaction.Stages[2].Ack = true
+	assert.True(t, transaction.CurrentStepCompleted())
+}
+
+func TestCanRecordProcessedMessages(t *testing.T) {
+	transaction := TransactionModel{}
+	assert.False(t, transaction.IsProcessed("6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11"))
+	transaction.MarkProcessed("6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11")
+	transaction.MarkProcessed("6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11")
+	//The messages without id cannot be recognized
+	transaction.MarkProcessed("")
+	assert.True(t, transaction.IsProcessed("6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11"))
+	assert.False(t, transaction.IsProcessed(""))
+	assert.Len(t, transaction.ProcessedMessages, 1)
+}
+
+func TestCanLimitProcessedMessages(t *testing.T) {
+	transaction := TransactionModel{}
+	for i := 0; i <= MaxProcessedMessages; i++ {
+		transaction.MarkProcessed(fmt.Sprintf("message-%d", i))
+	}
+	//Only the latest ids are kept
+	assert.Len(t, transaction.ProcessedMessages, MaxProcessedMessages)
+	assert.False(t, transaction.IsProcessed("message-0"))
+	assert.True(t, transaction.IsProcessed("message-1"))
+	assert.True(t, transaction.IsProcessed(fmt.Sprintf("message-%d", MaxProcessedMessages)))
+}
+
+func TestCanRecognizeVersionConflict(t *testing.T) {
+	err := &VersionConflictError{ID: "fa621107-5b79-4e8b-9587-df064f1052b4", Version: 3}
+	assert.True(t, IsVersionConflict(err))
+	assert.True(t, IsVersionConflict(errors.Wrap(err, "Cannot ack the stage")))
+	assert.False(t, IsVersionConflict(errors.New("Cannot update the model")))
+	assert.Equal(t, "The transaction fa621107-5b79-4e8b-9587-df064f1052b4 was changed since version 3", err.Error())
+}
+
+func TestCanTouchTransaction(t *testing.T) {
+	created := time.Date(2020, 11, 20, 10, 0, 0, 0, time.UTC)
+	transaction := TransactionModel{
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend"},
+			{Order: 1, Step: 1, Service: "billing"},
+			{Order: 2, Step: 1, Service: "admin", Skipped: true},
+			{Order: 3, Step: 1, Service: "image-processor"},
+		},
+	}
+	transaction.Touch(created)
+	assert.Equal(t, created, transaction.CreatedAt)
+	assert.Equal(t, []string{"billing", "image-processor"}, transaction.CurrentServices)
+	//The date of creation is kept by the next updates
+	transaction.Touch(created.Add(time.Hour))
+	assert.Equal(t, created, transaction.CreatedAt)
+	assert.Equal(t, created.Add(time.Hour), transaction.UpdatedAt)
+}
+
+func TestCanTouchTransactionWithSkippedStages(t *testing.T) {
+	transaction := TransactionModel{
+		Status: TransactionCompleted,
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+			{Order: 1, Step: 1, Service: "billing", Ack: true},
+			{Order: 2, Step: 2, Service: "image-processor", Ack: true, Skipped: true},
+		},
+	}
+	transaction.Touch(time.Now())
+	assert.Equal(t, []string{"billing"}, transaction.CurrentServices)
+}
+
+func TestCanMatchTransactionQuery(t *testing.T) {
+	failure := "Cannot charge the card"
+	today := time.Date(2020, 11, 20, 0, 0, 0, 0, time.UTC)
+	transaction := &TransactionModel{
+		Type:   "invoice.create",
+		Status: TransactionFailed,
+		Stages: []TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Ack: true},
+			{Order: 1, Step: 1, Service: "billing", Error: &failure},
+		},
+	}
+	transaction.Touch(today.Add(10 * time.Hour))
+	hasError := true
+	assert.True(t, (&TransactionQuery{
+		Types:    []string{"invoice.create"},
+		Statuses: []TransactionStatus{TransactionFailed},
+		Service:  "billing",
+		HasError: &hasError,
+		From:     today,
+		To:       today.Add(24 * time.Hour),
+	}).Matches(transaction))
+	assert.False(t, (&TransactionQuery{Types: []string{"account.create"}}).Matches(transaction))
+	assert.False(t, (&TransactionQuery{Statuses: []TransactionStatus{TransactionRunning}}).Matches(transaction))
+	assert.False(t, (&TransactionQuery{Service: "backend"}).Matches(transaction))
+	assert.False(t, (&TransactionQuery{From: today.Add(24 * time.Hour)}).Matches(transaction))
+	assert.False(t, (&TransactionQuery{To: today.Add(10 * time.Hour)}).Matches(transaction))
+	hasError = false
+	assert.False(t, (&TransactionQuery{HasError: &hasError}).Matches(transaction))
+}
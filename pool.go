@@ -0,0 +1,48 @@
+package cubequeue
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Processes the messages concurrently, the messages with the same key are always handled by the same goroutine, so they stay in order
+type partitionedPool struct {
+	partitions []chan func()
+	wait       sync.WaitGroup
+}
+
+func newPartitionedPool(size int) *partitionedPool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &partitionedPool{
+		partitions: make([]chan func(), size),
+	}
+	for index := range pool.partitions {
+		partition := make(chan func(), 1)
+		pool.partitions[index] = partition
+		pool.wait.Add(1)
+		go func() {
+			defer pool.wait.Done()
+			for task := range partition {
+				task()
+			}
+		}()
+	}
+	return pool
+}
+
+// Queue the task on the partition of the key, blocks while the partition is busy
+func (pool *partitionedPool) submit(key string, task func()) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	pool.partitions[hash.Sum32()%uint32(len(pool.partitions))] <- task
+}
+
+// Wait for the queued tasks to finish and stop the goroutines
+func (pool *partitionedPool) close() {
+	for _, partition := range pool.partitions {
+		close(partition)
+	}
+	pool.wait.Wait()
+}
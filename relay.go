@@ -0,0 +1,51 @@
+package cubequeue
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Periodically publish the messages left in the outboxes until the context is cancelled
+func (transactionOrchestrator *TransactionOrchestrator) relay(ctx context.Context) {
+	ticker := time.NewTicker(transactionOrchestrator.settings.RelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := transactionOrchestrator.relayOutbox(ctx)
+			if err != nil {
+				logrus.WithError(err).Error("Cannot relay the outbox messages")
+			}
+		}
+	}
+}
+
+// Go over the transactions with unpublished messages, those are left by a crash or by a failed publish
+func (transactionOrchestrator *TransactionOrchestrator) relayOutbox(ctx context.Context) error {
+	transactions, err := transactionOrchestrator.database.FindWithOutbox(ctx)
+	if err != nil {
+		return err
+	}
+	for _, transaction := range transactions {
+		err = transactionOrchestrator.relayLockedOutbox(ctx, transaction.ID)
+		if err != nil {
+			logrus.WithError(err).WithField("transaction", transaction.ID).Error("Cannot relay the outbox messages of the transaction")
+		}
+	}
+	return nil
+}
+
+// The outbox could be published by a handler since it was listed, so the transaction is loaded again under the lock
+func (transactionOrchestrator *TransactionOrchestrator) relayLockedOutbox(ctx context.Context, id string) error {
+	transactionOrchestrator.locks.Lock(id)
+	defer transactionOrchestrator.locks.Unlock(id)
+	transaction, err := transactionOrchestrator.database.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+	return transactionOrchestrator.flush(ctx, transaction)
+}
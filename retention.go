@@ -0,0 +1,181 @@
+package cubequeue
+
+import (
+	"context"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetentionBatchSize is how many transactions are removed at once when the batch size is not set
+const DefaultRetentionBatchSize = 100
+
+// GetDefaultRetentionStatuses returns the statuses the orchestrator does not change the transactions in anymore
+// The failed transactions are still to be rolled back, the running and rolling back transactions are never removed
+func GetDefaultRetentionStatuses() []models.TransactionStatus {
+	return []models.TransactionStatus{
+		models.TransactionCompleted,
+		models.TransactionRolledBack,
+		models.TransactionCompensationFailed,
+	}
+}
+
+// TransactionRetentionRule removes the transactions of the type and status that were not updated for longer than TTL
+// The empty type or status matches all of them, the most specific rule is used, the type is more specific than the status
+// The zero TTL keeps the matching transactions forever
+type TransactionRetentionRule struct {
+	Type   string
+	Status models.TransactionStatus
+	TTL    time.Duration
+}
+
+// TransactionRetentionSettings configures removing the finished transactions from the database
+type TransactionRetentionSettings struct {
+	// Interval is how often the expired transactions are removed, zero disables the retention
+	Interval time.Duration
+	Rules    []TransactionRetentionRule
+	// Archive keeps the expired transactions before they are removed, without it they are only removed
+	Archive ITransactionArchive
+	// BatchSize is how many transactions are archived and removed at once
+	BatchSize int
+	// Statuses are the statuses the transactions are removed in, GetDefaultRetentionStatuses is used if not set
+	// The transactions are removed regardless of the rules, so only the statuses that are never changed should be given
+	Statuses []models.TransactionStatus
+}
+
+// The filter of the expired transactions along with the retention of the rule it comes from
+type retentionFilter struct {
+	filter models.RetentionFilter
+	ttl    time.Duration
+}
+
+// Returns how specific the rule is for the status, -1 if it does not match the status
+func (rule *TransactionRetentionRule) specificity(status models.TransactionStatus) int {
+	if rule.Status != "" && rule.Status != status {
+		return -1
+	}
+	specificity := 0
+	if rule.Type != "" {
+		specificity += 2
+	}
+	if rule.Status != "" {
+		specificity++
+	}
+	return specificity
+}
+
+// Turn the rules into the filters, one per type with its own rule and one for all the other types of the status
+func (settings *TransactionRetentionSettings) filters() []retentionFilter {
+	statuses := settings.Statuses
+	if len(statuses) == 0 {
+		statuses = GetDefaultRetentionStatuses()
+	}
+	filters := []retentionFilter{}
+	for _, status := range statuses {
+		typed := map[string]TransactionRetentionRule{}
+		var fallback *TransactionRetentionRule
+		for index := range settings.Rules {
+			rule := settings.Rules[index]
+			specificity := rule.specificity(status)
+			if specificity < 0 {
+				continue
+			}
+			if rule.Type == "" {
+				if fallback == nil || specificity > fallback.specificity(status) {
+					fallback = &rule
+				}
+				continue
+			}
+			if current, ok := typed[rule.Type]; !ok || specificity > current.specificity(status) {
+				typed[rule.Type] = rule
+			}
+		}
+		excluded := []string{}
+		for transactionType, rule := range typed {
+			excluded = append(excluded, transactionType)
+			if rule.TTL > 0 {
+				filters = append(filters, retentionFilter{
+					filter: models.RetentionFilter{Status: status, Type: transactionType},
+					ttl:    rule.TTL,
+				})
+			}
+		}
+		if fallback != nil && fallback.TTL > 0 {
+			filters = append(filters, retentionFilter{
+				filter: models.RetentionFilter{Status: status, ExcludeTypes: excluded},
+				ttl:    fallback.TTL,
+			})
+		}
+	}
+	return filters
+}
+
+// RunRetention periodically removes the expired transactions until the context is cancelled
+func RunRetention(ctx context.Context, database ITransactionDatabase, settings TransactionRetentionSettings) {
+	ticker := time.NewTicker(settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := ApplyRetention(ctx, database, settings)
+			if err != nil {
+				logrus.WithError(err).Error("Cannot remove the expired transactions")
+			}
+			if removed > 0 {
+				logrus.WithField("transactions", removed).Info("Removed the expired transactions")
+			}
+		}
+	}
+}
+
+// ApplyRetention archives and removes the expired transactions once, it returns how many transactions were removed
+func ApplyRetention(ctx context.Context, database ITransactionDatabase, settings TransactionRetentionSettings) (int, error) {
+	return applyRetention(ctx, database, settings, time.Now())
+}
+
+func applyRetention(ctx context.Context, database ITransactionDatabase, settings TransactionRetentionSettings, now time.Time) (int, error) {
+	batchSize := settings.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultRetentionBatchSize
+	}
+	removed := 0
+	for _, retention := range settings.filters() {
+		filter := retention.filter
+		filter.UpdatedBefore = now.Add(-retention.ttl)
+		filter.Limit = batchSize
+		for {
+			transactions, err := database.FindExpired(ctx, filter)
+			if err != nil {
+				return removed, err
+			}
+			if len(transactions) == 0 {
+				break
+			}
+			if settings.Archive != nil {
+				err = settings.Archive.Archive(ctx, transactions)
+				if err != nil {
+					return removed, err
+				}
+			}
+			for _, transaction := range transactions {
+				err = database.Delete(ctx, transaction.ID, transaction.Version)
+				if err == ErrTransactionNotFound || models.IsVersionConflict(err) {
+					//The transaction was removed or changed in the meantime, the changed one is not expired anymore
+					logrus.WithError(err).WithField("transaction", transaction.ID).Debug("Skipping the removal of the transaction")
+					continue
+				}
+				if err != nil {
+					return removed, err
+				}
+				removed++
+			}
+			if len(transactions) < batchSize {
+				break
+			}
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,132 @@
+package cubequeue
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paladium/cubequeue/databases"
+	"github.com/paladium/cubequeue/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanUseMostSpecificRetentionRule(t *testing.T) {
+	settings := TransactionRetentionSettings{
+		Rules: []TransactionRetentionRule{
+			{TTL: 30 * 24 * time.Hour},
+			{Status: models.TransactionCompleted, TTL: 24 * time.Hour},
+			{Type: "invoice.create", TTL: 7 * 24 * time.Hour},
+			{Type: "invoice.create", Status: models.TransactionCompleted, TTL: time.Hour},
+			//The audited transactions are kept forever
+			{Type: "account.create"},
+		},
+	}
+	filters := map[models.TransactionStatus]map[string]time.Duration{}
+	for _, retention := range settings.filters() {
+		if filters[retention.filter.Status] == nil {
+			filters[retention.filter.Status] = map[string]time.Duration{}
+		}
+		filters[retention.filter.Status][retention.filter.Type] = retention.ttl
+		if retention.filter.Type == "" {
+			assert.ElementsMatch(t, []string{"invoice.create", "account.create"}, retention.filter.ExcludeTypes)
+		}
+	}
+	assert.Equal(t, map[string]time.Duration{"invoice.create": time.Hour, "": 24 * time.Hour}, filters[models.TransactionCompleted])
+	assert.Equal(t, map[string]time.Duration{"invoice.create": 7 * 24 * time.Hour, "": 30 * 24 * time.Hour}, filters[models.TransactionRolledBack])
+	//The running transactions are never removed, the failed ones are still to be rolled back
+	assert.NotContains(t, filters, models.TransactionRunning)
+	assert.NotContains(t, filters, models.TransactionRollingBack)
+	assert.NotContains(t, filters, models.TransactionFailed)
+}
+
+func TestCanKeepFailedTransactions(t *testing.T) {
+	database := databases.NewTransactionMemoryDatabase()
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionCompleted},
+		{ID: "2", Type: "invoice.create", Status: models.TransactionFailed},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	settings := TransactionRetentionSettings{
+		Rules: []TransactionRetentionRule{
+			{TTL: time.Hour},
+		},
+	}
+	//The failed transaction of the orchestrator waits for its rollback
+	removed, err := applyRetention(context.Background(), database, settings, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = database.Find(context.Background(), "2")
+	assert.Nil(t, err)
+	//The failed transaction is finished for the worker
+	settings.Statuses = []models.TransactionStatus{models.TransactionFailed}
+	removed, err = applyRetention(context.Background(), database, settings, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = database.Find(context.Background(), "2")
+	assert.Equal(t, ErrTransactionNotFound, err)
+}
+
+func TestCanArchiveExpiredTransactions(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	database := databases.NewTransactionMemoryDatabase()
+	for _, transaction := range []*models.TransactionModel{
+		{ID: "1", Type: "invoice.create", Status: models.TransactionCompleted},
+		{ID: "2", Type: "invoice.create", Status: models.TransactionRunning},
+		{ID: "3", Type: "account.create", Status: models.TransactionCompleted},
+		{ID: "4", Type: "invoice.create", Status: models.TransactionRolledBack},
+	} {
+		_, err := database.Create(context.Background(), transaction)
+		assert.Nil(t, err)
+	}
+	path := filepath.Join(directory, "transactions.jsonl.gz")
+	settings := TransactionRetentionSettings{
+		Rules: []TransactionRetentionRule{
+			{Type: "invoice.create", TTL: time.Hour},
+			{Status: models.TransactionCompleted, TTL: 24 * time.Hour},
+		},
+		Archive:   NewTransactionFileArchive(path, true),
+		BatchSize: 1,
+	}
+	//Nothing expired yet
+	removed, err := applyRetention(context.Background(), database, settings, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = applyRetention(context.Background(), database, settings, time.Now().Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	for _, id := range []string{"1", "4"} {
+		_, err = database.Find(context.Background(), id)
+		assert.Equal(t, ErrTransactionNotFound, err)
+	}
+	//The running transaction is kept no matter how old it is
+	removed, err = applyRetention(context.Background(), database, settings, time.Now().Add(48*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = database.Find(context.Background(), "2")
+	assert.Nil(t, err)
+	//Every batch is a separate gzip member, they are read as one stream
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	assert.Nil(t, err)
+	archived := []string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		transaction := models.TransactionModel{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &transaction))
+		archived = append(archived, transaction.ID)
+	}
+	assert.Nil(t, scanner.Err())
+	assert.Equal(t, []string{"1", "4", "3"}, archived)
+}
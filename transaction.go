@@ -1,202 +1,592 @@
 package cubequeue
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/paladium/cubequeue/models"
-	"github.com/streadway/amqp"
 )
 
+// TransactionOrchestratorSettings stores settings to configure the orchestrator
+type TransactionOrchestratorSettings struct {
+	// WatchdogInterval is how often the in-flight transactions are checked for expired stages, zero disables the watchdog
+	WatchdogInterval time.Duration
+	// RelayInterval is how often the messages left in the outboxes are published again, zero disables the relay
+	RelayInterval time.Duration
+	// ConflictRetries is how many times the message is handled again when another instance changed the transaction at the same time
+	ConflictRetries int
+	// ShutdownTimeout is how long Run waits for the messages being handled after the context is cancelled, zero waits until they finish
+	ShutdownTimeout time.Duration
+	// Retention removes the finished transactions from the database, it is disabled by default
+	Retention TransactionRetentionSettings
+}
+
+// GetDefaultTransactionOrchestratorSettings returns default settings, suitable for most cases
+func GetDefaultTransactionOrchestratorSettings() TransactionOrchestratorSettings {
+	return TransactionOrchestratorSettings{
+		WatchdogInterval: 10 * time.Second,
+		RelayInterval:    5 * time.Second,
+		ConflictRetries:  5,
+		ShutdownTimeout:  30 * time.Second,
+	}
+}
+
 // TransactionOrchestrator manager that is responsible for deciding where the message should go next
 type TransactionOrchestrator struct {
 	transactionConfig *models.TransactionConfig
-	transport         *TransactionTransport
+	transport         ITransactionTransport
 	database          ITransactionDatabase
+	settings          TransactionOrchestratorSettings
+	//Serializes the message handlers and the watchdog per transaction, so they do not overwrite each other's changes
+	locks *transactionLocks
 }
 
 // NewTransactionOrchestrator inits the manager
 func NewTransactionOrchestrator(
 	transactionConfig *models.TransactionConfig,
-	transport *TransactionTransport,
+	transport ITransactionTransport,
 	database ITransactionDatabase,
+	settings TransactionOrchestratorSettings,
 ) *TransactionOrchestrator {
 	return &TransactionOrchestrator{
 		transactionConfig: transactionConfig,
 		transport:         transport,
 		database:          database,
+		settings:          settings,
+		locks:             newTransactionLocks(),
 	}
 }
 
-func (transactionOrchestrator *TransactionOrchestrator) ackCurrentStage(transaction *models.TransactionModel, origin string) (*models.TransactionModel, error) {
-	if transaction.State().Service != origin {
-		return nil, errors.Errorf("The service origin does not match the latest stage - %s != %s", origin, transaction.State().Service)
+// Ack the stage the service is working on, the index of the stage is returned
+// The payload sent by the service is merged into the transaction payload, if it is given
+// The ack is not saved here, it is saved along with the next transition, so the ack and its messages cannot diverge
+func (transactionOrchestrator *TransactionOrchestrator) ackPendingStage(transaction *models.TransactionModel, origin string, output map[string]interface{}) (int, error) {
+	index := transaction.PendingStage(origin)
+	if index == -1 {
+		return 0, errors.Errorf("The service %s has no pending stage", origin)
 	}
-	if transaction.State().Ack {
-		return nil, errors.New("Latest stage is already ack")
+	transaction.Stages[index].Ack = true
+	if output != nil {
+		currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
+		transaction.Payload, transaction.Stages[index].ChangedKeys = models.MergePayload(currentTransactionConfig.PayloadMerge, transaction.Payload, output, origin)
 	}
-	transaction.AckLatestStage()
-	transaction, err := transactionOrchestrator.database.Update(transaction.ID, transaction)
-	if err != nil {
-		return nil, err
-	}
-	return transaction, nil
+	return index, nil
 }
 
-func (transactionOrchestrator *TransactionOrchestrator) genericTransaction(message amqp.Delivery) (*models.TransactionModel, error) {
+// Find the transaction and the stage the message is the answer of, the new transaction is created with the origin as the first stage
+// The error is given for the error message, its stage is never acked, so the error cannot be mistaken for the success
+func (transactionOrchestrator *TransactionOrchestrator) genericTransaction(ctx context.Context, message Message, errorMessage *string) (*models.TransactionModel, int, error) {
 	//Check whether the origin header is present
-	if _, ok := message.Headers["origin"]; !ok {
-		return nil, errors.New("Origin not given")
+	origin, ok := message.Headers["origin"].(string)
+	if !ok {
+		return nil, 0, errors.New("Origin not given")
 	}
-	origin := message.Headers["origin"].(string)
 	//Determine the current service
 	service, err := transactionOrchestrator.transactionConfig.FindServiceByName(origin)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	eventType := message.Type
+	//The error message keeps the transaction type in the header
+	if transactionType, ok := message.Headers["type"].(string); ok && message.Type == ErrorMessage {
+		eventType = transactionType
+	}
 	// Find the transaction first, if it does not exist, record it in db
-	transaction, err := transactionOrchestrator.database.Find(message.CorrelationId)
-	if err != nil {
-		//For now only work with json type
-		var body map[string]interface{}
-		err = json.Unmarshal(message.Body, &body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Cannot unmarshal the body")
+	transaction, err := transactionOrchestrator.database.Find(ctx, message.CorrelationID)
+	if err != nil && err != ErrTransactionNotFound {
+		return nil, 0, err
+	}
+	if err == ErrTransactionNotFound {
+		//For now only work with json type, the error message has no body
+		body := map[string]interface{}{}
+		if len(message.Body) > 0 {
+			err = json.Unmarshal(message.Body, &body)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "Cannot unmarshal the body")
+			}
 		}
 		//The transaction does not exist, therefore we record it in our database with the origin service being the first one
-		transaction, err = transactionOrchestrator.database.Create(&models.TransactionModel{
-			ID:      message.CorrelationId,
+		transaction = &models.TransactionModel{
+			ID:      message.CorrelationID,
 			Type:    eventType,
+			Status:  models.TransactionRunning,
 			Payload: body,
 			Stages: []models.TransactionStageModel{
 				{
 					Order:   0,
+					Step:    0,
 					Queue:   service.Queue,
 					Service: origin,
 					Date:    time.Now(),
-					Ack:     true,
+					Ack:     errorMessage == nil,
+					Error:   errorMessage,
 				},
 			},
-		})
+		}
+		if errorMessage != nil {
+			transaction.Status = models.TransactionFailed
+		}
+		transaction.MarkProcessed(message.ID)
+		transaction, err = transactionOrchestrator.database.Create(ctx, transaction)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-	} else {
-		//Otherwise simply ack the current service for the transaction
-		if transaction.State().Service != origin {
-			return nil, errors.Wrapf(errors.New("The service origin does not match the latest stage"), "%s != %s", origin, transaction.State().Service)
+		return transaction, 0, nil
+	}
+	transaction.MarkProcessed(message.ID)
+	if errorMessage != nil {
+		index := transaction.PendingStage(origin)
+		if index == -1 {
+			return nil, 0, errors.Errorf("The service %s has no pending stage", origin)
 		}
-		transaction, err = transactionOrchestrator.ackCurrentStage(transaction, origin)
+		return transaction, index, nil
+	}
+	//Otherwise ack the current service for the transaction, only the successful stages can change the payload
+	var output map[string]interface{}
+	if len(message.Body) > 0 {
+		err = json.Unmarshal(message.Body, &output)
 		if err != nil {
-			return nil, err
+			return nil, 0, errors.Wrap(err, "Cannot unmarshal the body")
 		}
 	}
-	return transaction, nil
+	index, err := transactionOrchestrator.ackPendingStage(transaction, origin, output)
+	if err != nil {
+		return nil, 0, err
+	}
+	return transaction, index, nil
 }
 
 // Resolve the transaction and determine what should happen next based on the transaction configuration
-func (transactionOrchestrator *TransactionOrchestrator) handleTransaction(message amqp.Delivery) error {
-	transaction, err := transactionOrchestrator.genericTransaction(message)
+func (transactionOrchestrator *TransactionOrchestrator) handleTransaction(ctx context.Context, message Message) error {
+	transaction, index, err := transactionOrchestrator.genericTransaction(ctx, message, nil)
 	if err != nil {
 		return err
 	}
+	if transaction.Status != models.TransactionRunning {
+		//The service finished after the transaction had failed, so its work has to be rolled back as well
+		return transactionOrchestrator.compensateLateStage(ctx, transaction, index)
+	}
+	//Wait for all the services running in parallel before moving on
+	if !transaction.CurrentStepCompleted() {
+		_, err = transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
+		return err
+	}
+	//The ack is saved along with the next step and its messages
+	return transactionOrchestrator.advance(ctx, transaction, nil)
+}
+
+// Move the transaction to the next step that should run or complete it if there are no steps left
+func (transactionOrchestrator *TransactionOrchestrator) advance(ctx context.Context, transaction *models.TransactionModel, headers map[string]interface{}) error {
 	if _, ok := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]; !ok {
 		return errors.New("Transaction type cannot be found")
 	}
-	currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
-	if !transaction.State().Ack {
-		return errors.New("The previous service did not send the ack")
-	}
-	transactionChain, err := models.NewTransactionChain(*transactionOrchestrator.transactionConfig, currentTransactionConfig)
+	transactionChain, err := models.NewTransactionChain(*transactionOrchestrator.transactionConfig, transactionOrchestrator.transactionConfig.Transactions[transaction.Type])
 	if err != nil {
 		return err
 	}
-	nextService, err := transactionChain.NextService(transaction)
-	if err != nil {
+	nextStep, skippedSteps, err := transactionChain.NextStep(transaction)
+	if err != nil && err != models.ErrNoMoreSteps {
 		return err
 	}
-	//Publish the message to this next service
+	//Keep the skipped stages in the history of the transaction
+	for _, skippedStep := range skippedSteps {
+		for _, service := range skippedStep.Services {
+			transaction.AddStage(models.TransactionStageModel{
+				Step:    skippedStep.Index,
+				Group:   skippedStep.Group,
+				Queue:   service.Queue,
+				Service: service.Name,
+				Skipped: true,
+				Ack:     true,
+				Date:    time.Now(),
+			})
+		}
+	}
+	if err == models.ErrNoMoreSteps {
+		return transactionOrchestrator.complete(ctx, transaction)
+	}
+	indexes := []int{}
+	for _, service := range nextStep.Services {
+		transaction.AddStage(models.TransactionStageModel{
+			Step:    nextStep.Index,
+			Group:   nextStep.Group,
+			Queue:   service.Queue,
+			Service: service.Name,
+			Ack:     false,
+			Date:    time.Now(),
+		})
+		indexes = append(indexes, len(transaction.Stages)-1)
+	}
+	return transactionOrchestrator.dispatch(ctx, transaction, headers, indexes...)
+}
+
+// StartTransaction records a new transaction and sends it to the services of its first stage
+func (transactionOrchestrator *TransactionOrchestrator) StartTransaction(ctx context.Context, transactionType string, payload map[string]interface{}, options StartTransactionOptions) (*TransactionHandle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := transactionOrchestrator.transactionConfig.Transactions[transactionType]; !ok {
+		return nil, errors.Errorf("Transaction type %s cannot be found", transactionType)
+	}
+	id := options.ID
+	if id == "" {
+		var err error
+		id, err = NewTransactionID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	transactionOrchestrator.locks.Lock(id)
+	defer transactionOrchestrator.locks.Unlock(id)
+	_, err := transactionOrchestrator.database.Find(ctx, id)
+	if err == nil {
+		return nil, errors.Errorf("The transaction %s already exists", id)
+	}
+	if err != ErrTransactionNotFound {
+		return nil, err
+	}
+	transaction, err := transactionOrchestrator.database.Create(ctx, &models.TransactionModel{
+		ID:      id,
+		Type:    transactionType,
+		Status:  models.TransactionRunning,
+		Payload: payload,
+		Stages:  []models.TransactionStageModel{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = transactionOrchestrator.advance(ctx, transaction, options.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransactionHandle(id, transactionType, transactionOrchestrator.database), nil
+}
+
+// Save the new attempt of the given stages to db along with the messages to their services and publish them
+func (transactionOrchestrator *TransactionOrchestrator) dispatch(ctx context.Context, transaction *models.TransactionModel, headers map[string]interface{}, indexes ...int) error {
 	body, err := json.Marshal(transaction.Payload)
 	if err != nil {
 		return errors.Wrap(err, "Cannot marshal the body")
 	}
-	//Save the stage to db
-	transaction.AddStage(models.TransactionStageModel{
-		Queue:   nextService.Queue,
-		Service: nextService.Name,
-		Ack:     false,
-		Date:    time.Now(),
-	})
-	transaction, err = transactionOrchestrator.database.Update(transaction.ID, transaction)
+	currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
+	now := time.Now()
+	for _, index := range indexes {
+		stage := &transaction.Stages[index]
+		stage.StartAttempt(now, currentTransactionConfig.ServiceSettings(stage.Service, stage.Group).Timeout)
+		order := stage.Order
+		err = transactionOrchestrator.enqueue(transaction, stage.Queue, Message{
+			Type:          transaction.Type,
+			CorrelationID: transaction.ID,
+			Headers:       headers,
+			Body:          body,
+		}, &order)
+		if err != nil {
+			return err
+		}
+	}
+	transaction, err = transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
 	if err != nil {
 		return err
 	}
-	err = transactionOrchestrator.transport.Publish(nextService.Queue, amqp.Publishing{
-		Type:          transaction.Type,
-		CorrelationId: transaction.ID,
-		Body:          body,
+	return transactionOrchestrator.flush(ctx, transaction)
+}
+
+// Add the message to the outbox of the transaction, it is saved with the next update of the transaction
+func (transactionOrchestrator *TransactionOrchestrator) enqueue(transaction *models.TransactionModel, queue string, message Message, stage *int) error {
+	//The message sent again keeps its id, so it is recognized as the duplicate
+	id := message.ID
+	if id == "" {
+		var err error
+		id, err = NewMessageID()
+		if err != nil {
+			return err
+		}
+	}
+	transaction.Outbox = append(transaction.Outbox, models.OutboxMessageModel{
+		ID:      id,
+		Queue:   queue,
+		Type:    message.Type,
+		Headers: message.Headers,
+		Body:    message.Body,
+		Stage:   stage,
+		Date:    time.Now(),
 	})
+	return nil
+}
+
+// Publish the messages in the outbox of the saved transaction and remove the published ones
+// The message that was not confirmed by the broker never reaches the service, so its stage fails right away
+// The other messages are kept in the outbox and published again by the relay
+func (transactionOrchestrator *TransactionOrchestrator) flush(ctx context.Context, transaction *models.TransactionModel) error {
+	if len(transaction.Outbox) == 0 {
+		return nil
+	}
+	kept := []models.OutboxMessageModel{}
+	failed := []int{}
+	failures := map[int]error{}
+	for _, message := range transaction.Outbox {
+		err := transactionOrchestrator.transport.Publish(message.Queue, Message{
+			ID:            message.ID,
+			Type:          message.Type,
+			CorrelationID: transaction.ID,
+			Headers:       message.Headers,
+			Body:          message.Body,
+		})
+		if err == nil {
+			continue
+		}
+		if message.Stage != nil {
+			if index := transaction.FindStage(*message.Stage); index >= 0 {
+				failed = append(failed, index)
+				failures[index] = err
+			}
+			continue
+		}
+		logrus.WithError(err).WithField("transaction", transaction.ID).WithField("queue", message.Queue).Warn("Cannot publish the message, it is kept in the outbox")
+		kept = append(kept, message)
+	}
+	transaction.Outbox = kept
+	transaction, err := transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
 	if err != nil {
 		return err
 	}
+	for _, index := range failed {
+		if transaction.Status != models.TransactionRunning {
+			continue
+		}
+		logrus.WithError(failures[index]).WithField("transaction", transaction.ID).WithField("service", transaction.Stages[index].Service).Warn("Cannot dispatch the stage")
+		err = transactionOrchestrator.failStage(ctx, transaction, index, errors.Wrap(failures[index], "Cannot dispatch the stage").Error())
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (transactionOrchestrator *TransactionOrchestrator) rollback(transaction *models.TransactionModel) error {
-	//Notify all the previous services about the rollback
-	latestStageIndex := len(transaction.Stages) - 1
-	for i := 0; i < latestStageIndex; i++ {
-		stage := transaction.Stages[i]
-		err := transactionOrchestrator.transport.Publish(stage.Queue, amqp.Publishing{
-			Type: RollbackMessage,
-			Headers: amqp.Table{
-				"error": *transaction.State().Error,
-			},
-			CorrelationId: transaction.ID,
-		})
+// Fail the given stage, the stage is retried later if its retry policy allows it, otherwise the transaction is rolled back
+func (transactionOrchestrator *TransactionOrchestrator) failStage(ctx context.Context, transaction *models.TransactionModel, index int, errorMessage string) error {
+	currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
+	stage := &transaction.Stages[index]
+	retryPolicy := currentTransactionConfig.ServiceSettings(stage.Service, stage.Group).Retry
+	attempts := len(stage.Attempts)
+	stage.SetErrorLatestAttempt(errorMessage)
+	//Only the stages dispatched by the orchestrator can be retried
+	if attempts > 0 && attempts < retryPolicy.MaxAttempts {
+		stage.ScheduleRetry(time.Now().Add(retryPolicy.Backoff(attempts)))
+		_, err := transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
 		if err != nil {
 			return err
 		}
+		logrus.WithField("transaction", transaction.ID).WithField("service", stage.Service).Debug("Stage will be retried")
+		return nil
+	}
+	stage.Error = &errorMessage
+	transaction.Status = models.TransactionFailed
+	transaction, err := transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
+	if err != nil {
+		return err
 	}
+	//Finally send the rollback message to all the previous services
+	return transactionOrchestrator.rollback(ctx, transaction)
+}
+
+// Mark the transaction as completed once every stage has sent the ack
+func (transactionOrchestrator *TransactionOrchestrator) complete(ctx context.Context, transaction *models.TransactionModel) error {
+	transaction.Status = models.TransactionCompleted
+	_, err := transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
+	if err != nil {
+		return err
+	}
+	logrus.WithField("transaction", transaction.ID).Debug("Transaction completed")
 	return nil
 }
 
-func (transactionOrchestrator *TransactionOrchestrator) handleError(message amqp.Delivery) error {
-	transaction, err := transactionOrchestrator.genericTransaction(message)
+// Queue the rollback message to a single stage, the stage order is sent back by the service along with the result of the compensation
+// The stage without the id of the rollback message gets a new one, otherwise the message is sent again with the same id
+func (transactionOrchestrator *TransactionOrchestrator) enqueueRollback(transaction *models.TransactionModel, stage *models.TransactionStageModel) error {
+	if stage.CompensationMessage == "" {
+		id, err := NewMessageID()
+		if err != nil {
+			return err
+		}
+		stage.CompensationMessage = id
+	}
+	return transactionOrchestrator.enqueue(transaction, stage.Queue, Message{
+		ID:   stage.CompensationMessage,
+		Type: RollbackMessage,
+		Headers: map[string]interface{}{
+			"error": transaction.FailureError(),
+			"stage": int32(stage.Order),
+		},
+		CorrelationID: transaction.ID,
+	}, nil)
+}
+
+// Send the rollback messages to the stages whose turn has come according to the rollback strategy
+func (transactionOrchestrator *TransactionOrchestrator) compensate(ctx context.Context, transaction *models.TransactionModel) error {
+	currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
+	indexes := transaction.NextCompensations(currentTransactionConfig.RollbackStrategy)
+	now := time.Now()
+	for _, index := range indexes {
+		transaction.Stages[index].StartCompensation(now, currentTransactionConfig.GetCompensationTimeout())
+		transaction.Stages[index].CompensationMessage = ""
+		err := transactionOrchestrator.enqueueRollback(transaction, &transaction.Stages[index])
+		if err != nil {
+			return err
+		}
+	}
+	transaction.Status = transaction.RollbackStatus()
+	transaction, err := transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
 	if err != nil {
 		return err
 	}
-	if transaction.State().Error != nil {
-		return errors.New("Latest stage already has an error")
+	return transactionOrchestrator.flush(ctx, transaction)
+}
+
+func (transactionOrchestrator *TransactionOrchestrator) rollback(ctx context.Context, transaction *models.TransactionModel) error {
+	//Mark all the stages that finished successfully as waiting for the compensation, if the very first stage failed there is nothing to compensate
+	//The services still running in parallel are compensated once they send the ack
+	for index, stage := range transaction.Stages {
+		if stage.Ack && !stage.HasError() && !stage.Skipped && stage.Compensation == "" {
+			transaction.Stages[index].Compensation = models.CompensationPending
+			transaction.Stages[index].CompensationAttempts = 0
+		}
 	}
-	if _, ok := message.Headers["error"]; !ok {
-		return errors.New("Error message not given")
+	return transactionOrchestrator.compensate(ctx, transaction)
+}
+
+// Roll back the stage that sent the ack after the transaction had already failed
+func (transactionOrchestrator *TransactionOrchestrator) compensateLateStage(ctx context.Context, transaction *models.TransactionModel, index int) error {
+	switch transaction.Status {
+	case models.TransactionRollingBack, models.TransactionRolledBack, models.TransactionCompensationFailed:
+	default:
+		return errors.Errorf("The transaction is not running anymore - %s", transaction.Status)
+	}
+	transaction.Stages[index].Compensation = models.CompensationPending
+	transaction.Stages[index].CompensationAttempts = 0
+	return transactionOrchestrator.compensate(ctx, transaction)
+}
+
+// Find the transaction and the stage the service reports the compensation result for
+func (transactionOrchestrator *TransactionOrchestrator) compensatingStage(ctx context.Context, message Message) (*models.TransactionModel, int, error) {
+	origin, ok := message.Headers["origin"].(string)
+	if !ok {
+		return nil, 0, errors.New("Origin not given")
+	}
+	order, err := headerInt(message.Headers, "stage")
+	if err != nil {
+		return nil, 0, err
+	}
+	transaction, err := transactionOrchestrator.database.Find(ctx, message.CorrelationID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if transaction.Status != models.TransactionRollingBack {
+		return nil, 0, errors.Errorf("The transaction is not rolling back - %s", transaction.Status)
+	}
+	index := transaction.FindStage(order)
+	if index == -1 {
+		return nil, 0, errors.Errorf("Stage %d cannot be found", order)
 	}
-	//Set the error on the latest stage and update the transaction in database
-	errorMessage := message.Headers["error"].(string)
-	transaction.SetErrorLatestStage(errorMessage)
-	transaction, err = transactionOrchestrator.database.Update(transaction.ID, transaction)
+	stage := transaction.Stages[index]
+	if stage.Service != origin {
+		return nil, 0, errors.Errorf("The service origin does not match the stage - %s != %s", origin, stage.Service)
+	}
+	if stage.Compensation != models.CompensationPending {
+		return nil, 0, errors.Errorf("The stage is not waiting for the compensation - %s", stage.Compensation)
+	}
+	transaction.MarkProcessed(message.ID)
+	return transaction, index, nil
+}
+
+func (transactionOrchestrator *TransactionOrchestrator) handleRollbackAck(ctx context.Context, message Message) error {
+	transaction, index, err := transactionOrchestrator.compensatingStage(ctx, message)
 	if err != nil {
 		return err
 	}
-	//Finally send the rollback message to all the previous services
-	err = transactionOrchestrator.rollback(transaction)
+	transaction.Stages[index].Compensation = models.CompensationCompleted
+	//Move on to the next compensation if they are sent one by one
+	return transactionOrchestrator.compensate(ctx, transaction)
+}
+
+func (transactionOrchestrator *TransactionOrchestrator) handleRollbackError(ctx context.Context, message Message) error {
+	transaction, index, err := transactionOrchestrator.compensatingStage(ctx, message)
 	if err != nil {
 		return err
 	}
-	return nil
+	errorMessage, ok := message.Headers["error"].(string)
+	if !ok {
+		return errors.New("Error message not given")
+	}
+	return transactionOrchestrator.failCompensation(ctx, transaction, index, errorMessage, false)
+}
+
+// Fail the latest compensation attempt of the stage, the rollback message is sent again until we run out of attempts
+// The lost message is sent again with the same id, while the failed compensation is tried again with a new message
+func (transactionOrchestrator *TransactionOrchestrator) failCompensation(ctx context.Context, transaction *models.TransactionModel, index int, errorMessage string, lost bool) error {
+	stage := &transaction.Stages[index]
+	stage.CompensationError = &errorMessage
+	currentTransactionConfig := transactionOrchestrator.transactionConfig.Transactions[transaction.Type]
+	if stage.CompensationAttempts < currentTransactionConfig.MaxCompensationAttempts() {
+		stage.StartCompensation(time.Now(), currentTransactionConfig.GetCompensationTimeout())
+		if !lost {
+			stage.CompensationMessage = ""
+		}
+		err := transactionOrchestrator.enqueueRollback(transaction, stage)
+		if err != nil {
+			return err
+		}
+		transaction, err = transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
+		if err != nil {
+			return err
+		}
+		return transactionOrchestrator.flush(ctx, transaction)
+	}
+	stage.Compensation = models.CompensationFailed
+	//The compensations that are still waiting might depend on the failed one, so they are never sent
+	if currentTransactionConfig.RollbackStrategy == models.RollbackReverseSequential {
+		transaction.CancelCompensations()
+	}
+	return transactionOrchestrator.compensate(ctx, transaction)
+}
+
+func (transactionOrchestrator *TransactionOrchestrator) handleError(ctx context.Context, message Message) error {
+	errorMessage, ok := message.Headers["error"].(string)
+	if !ok {
+		return errors.New("Error message not given")
+	}
+	transaction, index, err := transactionOrchestrator.genericTransaction(ctx, message, &errorMessage)
+	if err != nil {
+		return err
+	}
+	if transaction.Status == models.TransactionFailed && transaction.Stages[index].HasError() {
+		//The transaction was created by the error of its first stage, there is nothing to compensate
+		return transactionOrchestrator.rollback(ctx, transaction)
+	}
+	if transaction.Status != models.TransactionRunning {
+		//The transaction is already rolling back, there is nothing to compensate for the failed stage
+		transaction.Stages[index].Error = &errorMessage
+		_, err = transactionOrchestrator.database.Update(ctx, transaction.ID, transaction)
+		return err
+	}
+	//The error is saved along with the message, either the stage is retried or the transaction is rolled back
+	return transactionOrchestrator.failStage(ctx, transaction, index, errorMessage)
 }
 
 // Run functions goes over each routing table item and wraps the function to persist the transaction and notify other services further
-func (transactionOrchestrator *TransactionOrchestrator) Run(routingTable RoutingTable, settings SubscribeSettings) error {
+// Run blocks until the context is cancelled, then it stops consuming, waits for the messages being handled and closes the connections
+func (transactionOrchestrator *TransactionOrchestrator) Run(ctx context.Context, routingTable RoutingTable, settings SubscribeSettings) error {
+	routes := map[string]transactionHandler{}
 	for key, handler := range routingTable {
-		routingTable[key] = func(message amqp.Delivery) error {
+		handler := handler
+		routes[key] = func(ctx context.Context, message Message) error {
 			//Save transaction or update current status of it
-			err := transactionOrchestrator.handleTransaction(message)
+			err := transactionOrchestrator.handleTransaction(ctx, message)
 			if err != nil {
 				return err
 			}
@@ -207,18 +597,151 @@ func (transactionOrchestrator *TransactionOrchestrator) Run(routingTable Routing
 			return nil
 		}
 	}
-	//Add the error handling route
-	routingTable[ErrorMessage] = transactionOrchestrator.handleError
+	//Add the error and compensation handling routes
+	routes[ErrorMessage] = transactionOrchestrator.handleError
+	routes[RollbackAckMessage] = transactionOrchestrator.handleRollbackAck
+	routes[RollbackErrorMessage] = transactionOrchestrator.handleRollbackError
+	for key, handler := range routes {
+		routingTable[key] = transactionOrchestrator.synchronized(transactionOrchestrator.deduplicated(transactionOrchestrator.retried(handler)))
+	}
+	//The watchdog, the relay and the retention run for as long as we are subscribed
+	backgroundContext, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	var background sync.WaitGroup
+	if transactionOrchestrator.settings.WatchdogInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			transactionOrchestrator.watch(backgroundContext)
+		}()
+	}
+	if transactionOrchestrator.settings.RelayInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			transactionOrchestrator.relay(backgroundContext)
+		}()
+	}
+	if transactionOrchestrator.settings.Retention.Interval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			RunRetention(backgroundContext, transactionOrchestrator.database, transactionOrchestrator.settings.Retention)
+		}()
+	}
 	logrus.Debug("Running the orchestrator")
-	err := transactionOrchestrator.transport.Subscribe(routingTable, settings)
-	if err != nil {
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- transactionOrchestrator.transport.Subscribe(ctx, routingTable, settings)
+	}()
+	select {
+	case err := <-subscribed:
+		if ctx.Err() == nil {
+			return err
+		}
+	case <-ctx.Done():
+		if !drain(subscribed, transactionOrchestrator.settings.ShutdownTimeout) {
+			logrus.Warn("The messages being handled did not finish in time, closing the orchestrator anyway")
+		}
+	}
+	stopBackground()
+	background.Wait()
+	transactionOrchestrator.Close()
+	logrus.Debug("The orchestrator stopped")
+	return nil
+}
+
+// Wait for the subscription to return up to the timeout, zero timeout waits until it returns
+func drain(subscribed <-chan error, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case err := <-subscribed:
+		if err != nil {
+			logrus.WithError(err).Warn("The subscription stopped with an error")
+		}
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// The handler of the orchestrator, the context is given to the database calls
+type transactionHandler func(ctx context.Context, message Message) error
+
+// Wrap the handler, so only one of them changes the transaction at a time
+// The handlers are not cancelled along with Run, so the messages being handled are finished during the shutdown
+func (transactionOrchestrator *TransactionOrchestrator) synchronized(handler transactionHandler) RoutingTableHandler {
+	return func(message Message) error {
+		transactionOrchestrator.locks.Lock(message.CorrelationID)
+		defer transactionOrchestrator.locks.Unlock(message.CorrelationID)
+		return handler(context.Background(), message)
+	}
+}
+
+// Wrap the handler, so the message that already changed the transaction is acknowledged without running the handler again
+func (transactionOrchestrator *TransactionOrchestrator) deduplicated(handler transactionHandler) transactionHandler {
+	return func(ctx context.Context, message Message) error {
+		if message.ID != "" {
+			transaction, err := transactionOrchestrator.database.Find(ctx, message.CorrelationID)
+			if err != nil && err != ErrTransactionNotFound {
+				return err
+			}
+			if err == nil && transaction.IsProcessed(message.ID) {
+				logrus.WithField("transaction", message.CorrelationID).WithField("message", message.ID).Debug("Ignoring the duplicate message")
+				if transaction.IsFinished() {
+					return nil
+				}
+				//The message was saved, but the rest of the transition could be interrupted, so it is done again
+				return transactionOrchestrator.resume(ctx, transaction)
+			}
+		}
+		return handler(ctx, message)
+	}
+}
+
+// Wrap the handler, so it is done again on the reloaded transaction when another instance changed the transaction in the meantime
+func (transactionOrchestrator *TransactionOrchestrator) retried(handler transactionHandler) transactionHandler {
+	return func(ctx context.Context, message Message) error {
+		err := handler(ctx, message)
+		for attempt := 1; models.IsVersionConflict(err) && attempt <= transactionOrchestrator.settings.ConflictRetries; attempt++ {
+			logrus.WithError(err).WithField("transaction", message.CorrelationID).WithField("attempt", attempt).Debug("The transaction was changed by someone else, retrying")
+			transaction, findErr := transactionOrchestrator.database.Find(ctx, message.CorrelationID)
+			if findErr != nil {
+				return findErr
+			}
+			if transaction.IsProcessed(message.ID) {
+				//The message was saved before the conflict, only the rest of the transition is done again
+				err = transactionOrchestrator.resume(ctx, transaction)
+				continue
+			}
+			err = handler(ctx, message)
+		}
 		return err
 	}
+}
+
+// Continue the transition of the transaction from its saved state
+func (transactionOrchestrator *TransactionOrchestrator) resume(ctx context.Context, transaction *models.TransactionModel) error {
+	switch transaction.Status {
+	case models.TransactionRunning:
+		if !transaction.CurrentStepCompleted() {
+			return nil
+		}
+		return transactionOrchestrator.advance(ctx, transaction, nil)
+	case models.TransactionFailed:
+		//The failure is saved, but the rollback is not started yet
+		return transactionOrchestrator.rollback(ctx, transaction)
+	case models.TransactionRollingBack:
+		return transactionOrchestrator.compensate(ctx, transaction)
+	}
 	return nil
 }
 
 // Close all connections
 func (transactionOrchestrator *TransactionOrchestrator) Close() {
 	transactionOrchestrator.transport.Close()
-	transactionOrchestrator.database.Close()
+	transactionOrchestrator.database.Close(context.Background())
 }
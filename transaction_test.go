@@ -1,14 +1,21 @@
 package cubequeue
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/paladium/cubequeue/databases"
 	"github.com/paladium/cubequeue/models"
-	"github.com/streadway/amqp"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCanRunTransactionOrchestrator(t *testing.T) {
@@ -52,11 +59,11 @@ func TestCanRunTransactionOrchestrator(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 }
@@ -102,11 +109,11 @@ func TestExecuteNewTransaction(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 
@@ -122,21 +129,22 @@ func TestExecuteNewTransaction(t *testing.T) {
 	messageBody, err := json.Marshal(createInvoice)
 	assert.Nil(t, err)
 
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "backend",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we find our transaction in db and verify its fields
-	transaction, err := database.Find("fa621107-5b79-4e8b-9587-df064f1052b4")
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
 	assert.Nil(t, err)
 	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", transaction.ID)
 	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
 	assert.Equal(t, map[string]interface{}{
 		"invoiceNumber": "34555678",
 		"filename":      "invoice-34555678.pdf",
@@ -198,11 +206,11 @@ func TestCanAckExistingTransaction(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 
@@ -218,32 +226,33 @@ func TestCanAckExistingTransaction(t *testing.T) {
 	messageBody, err := json.Marshal(createInvoice)
 	assert.Nil(t, err)
 
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "backend",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we publish the message from billing service, that we have finished processing the transaction
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "billing",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we find our transaction in db and verify its fields
-	transaction, err := database.Find("fa621107-5b79-4e8b-9587-df064f1052b4")
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
 	assert.Nil(t, err)
 	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", transaction.ID)
 	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
 	assert.Equal(t, map[string]interface{}{
 		"invoiceNumber": "34555678",
 		"filename":      "invoice-34555678.pdf",
@@ -269,6 +278,8 @@ func TestCanAckExistingTransaction(t *testing.T) {
 	assert.Equal(t, 2, transaction.Stages[2].Order)
 	assert.Nil(t, transaction.Stages[2].Error)
 	assert.Equal(t, false, transaction.Stages[2].Ack)
+	//All the messages were published, so nothing is left in the outbox
+	assert.Empty(t, transaction.Outbox)
 }
 
 func TestCanFinishExistingTransaction(t *testing.T) {
@@ -312,11 +323,11 @@ func TestCanFinishExistingTransaction(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 
@@ -332,43 +343,44 @@ func TestCanFinishExistingTransaction(t *testing.T) {
 	messageBody, err := json.Marshal(createInvoice)
 	assert.Nil(t, err)
 
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "backend",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we publish the message from billing service, that we have finished processing the transaction
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "billing",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Finally we publish success message from admin service
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "admin",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we find our transaction in db and verify its fields
-	transaction, err := database.Find("fa621107-5b79-4e8b-9587-df064f1052b4")
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
 	assert.Nil(t, err)
 	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", transaction.ID)
 	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, models.TransactionCompleted, transaction.Status)
 	assert.Equal(t, map[string]interface{}{
 		"invoiceNumber": "34555678",
 		"filename":      "invoice-34555678.pdf",
@@ -437,11 +449,11 @@ func TestCanErrorExistingTransaction(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 
@@ -457,11 +469,11 @@ func TestCanErrorExistingTransaction(t *testing.T) {
 	messageBody, err := json.Marshal(createInvoice)
 	assert.Nil(t, err)
 
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "backend",
 		},
 	})
@@ -469,11 +481,11 @@ func TestCanErrorExistingTransaction(t *testing.T) {
 	time.Sleep(5 * time.Second)
 	//Next we publish the message from billing service, that we have finished processing the transaction
 	errorString := "The invoice with the same number already exists"
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "error",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "billing",
 			"error":  errorString,
 		},
@@ -481,10 +493,11 @@ func TestCanErrorExistingTransaction(t *testing.T) {
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we find our transaction in db and verify its fields
-	transaction, err := database.Find("fa621107-5b79-4e8b-9587-df064f1052b4")
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
 	assert.Nil(t, err)
 	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", transaction.ID)
 	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
 	assert.Equal(t, map[string]interface{}{
 		"invoiceNumber": "34555678",
 		"filename":      "invoice-34555678.pdf",
@@ -502,7 +515,7 @@ func TestCanErrorExistingTransaction(t *testing.T) {
 	assert.Equal(t, "billing", transaction.Stages[1].Service)
 	assert.Equal(t, 1, transaction.Stages[1].Order)
 	assert.Equal(t, errorString, *transaction.Stages[1].Error)
-	assert.Equal(t, true, transaction.Stages[1].Ack)
+	assert.Equal(t, false, transaction.Stages[1].Ack)
 }
 
 func TestCannotAckNextService(t *testing.T) {
@@ -546,11 +559,11 @@ func TestCannotAckNextService(t *testing.T) {
 				},
 			},
 		},
-	}, transport, database)
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
 	assert.NotNil(t, orchestrator)
 	defer orchestrator.Close()
 	defer database.DeleteDatabase()
-	go orchestrator.Run(RoutingTable{
+	go orchestrator.Run(context.Background(), RoutingTable{
 		"invoice.create": GetDefaultRoutingHandler(),
 	}, GetDefaultSubscribeSettings("cubequeue"))
 
@@ -566,32 +579,33 @@ func TestCannotAckNextService(t *testing.T) {
 	messageBody, err := json.Marshal(createInvoice)
 	assert.Nil(t, err)
 
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "backend",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we publish the message from billing service, that we have finished processing the transaction
-	transport.Publish("cubequeue", amqp.Publishing{
-		CorrelationId: "fa621107-5b79-4e8b-9587-df064f1052b4",
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
 		Type:          "invoice.create",
 		Body:          messageBody,
-		Headers: amqp.Table{
+		Headers: map[string]interface{}{
 			"origin": "admin",
 		},
 	})
 	//Simulate wait to process the message
 	time.Sleep(5 * time.Second)
 	//Next we find our transaction in db and verify its fields
-	transaction, err := database.Find("fa621107-5b79-4e8b-9587-df064f1052b4")
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
 	assert.Nil(t, err)
 	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", transaction.ID)
 	assert.Equal(t, "invoice.create", transaction.Type)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
 	assert.Equal(t, map[string]interface{}{
 		"invoiceNumber": "34555678",
 		"filename":      "invoice-34555678.pdf",
@@ -611,3 +625,1278 @@ func TestCannotAckNextService(t *testing.T) {
 	assert.Nil(t, transaction.Stages[1].Error)
 	assert.Equal(t, false, transaction.Stages[1].Ack)
 }
+
+func TestCanTimeoutStage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+				StageSettings: map[string]models.TransactionStageSettings{
+					"billing": {
+						Timeout: 2 * time.Second,
+					},
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		WatchdogInterval: time.Second,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	//Billing never answers, so the watchdog should fail the stage
+	time.Sleep(5 * time.Second)
+	assert.Len(t, broker.Pending("cube-billing"), 1)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Len(t, transaction.Stages, 2)
+	assert.NotNil(t, transaction.Stages[1].Deadline)
+	assert.NotNil(t, transaction.Stages[1].Error)
+	assert.Equal(t, false, transaction.Stages[1].Ack)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[0].Compensation)
+}
+
+// The transport that publishes only to the known queues, like the broker returning the mandatory messages it cannot route
+type routingTransport struct {
+	ITransactionTransport
+	queues []string
+}
+
+func (transport *routingTransport) Publish(queue string, message Message) error {
+	for _, known := range transport.queues {
+		if known == queue {
+			return transport.ITransactionTransport.Publish(queue, message)
+		}
+	}
+	return ErrMessageUnroutable
+}
+
+func TestCanFailUnroutableStage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-bilign",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, &routingTransport{ITransactionTransport: transport, queues: []string{"cubequeue", "cube-backend", "cube-billing"}}, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	//The queue of billing is misspelled, so the message cannot be routed and the stage fails
+	time.Sleep(2 * time.Second)
+	assert.Empty(t, broker.Pending("cube-bilign"))
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Len(t, transaction.Stages, 2)
+	assert.NotNil(t, transaction.Stages[1].Error)
+	assert.Equal(t, false, transaction.Stages[1].Ack)
+}
+
+func TestCanRelayOutbox(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		RelayInterval: time.Second,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	//The orchestrator crashed after saving the stage, but before publishing the message to billing
+	order := 1
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+		Stages: []models.TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now()},
+			{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Ack: false, Date: time.Now()},
+		},
+		Outbox: []models.OutboxMessageModel{
+			{
+				ID:    "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+				Queue: "cube-billing",
+				Type:  "invoice.create",
+				Body:  []byte(`{"invoiceNumber":"34555678"}`),
+				Stage: &order,
+				Date:  time.Now(),
+			},
+		},
+	})
+	assert.Nil(t, err)
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+	time.Sleep(3 * time.Second)
+	pending := broker.Pending("cube-billing")
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "fa621107-5b79-4e8b-9587-df064f1052b4", pending[0].CorrelationID)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Empty(t, transaction.Outbox)
+}
+
+func TestCanIgnoreDuplicateMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+			"admin": {
+				Description: "Admin service",
+				Name:        "admin",
+				Queue:       "cube-admin",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+					"admin",
+				},
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		ID:            "0b7d1d3c-55c1-4f3e-8d7a-3f2a9c1e6b21",
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	//The ack of billing is delivered twice
+	for i := 0; i < 2; i++ {
+		transport.Publish("cubequeue", Message{
+			ID:            "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+			CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+			Type:          "invoice.create",
+			Body:          []byte(`{"invoiceNumber":"34555678"}`),
+			Headers: map[string]interface{}{
+				"origin": "billing",
+			},
+		})
+	}
+	time.Sleep(2 * time.Second)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Len(t, transaction.Stages, 3)
+	assert.Equal(t, true, transaction.Stages[1].Ack)
+	assert.Nil(t, transaction.Stages[1].Error)
+	assert.Equal(t, false, transaction.Stages[2].Ack)
+	assert.Equal(t, []string{"0b7d1d3c-55c1-4f3e-8d7a-3f2a9c1e6b21", "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11"}, transaction.ProcessedMessages)
+	//Admin received the transaction only once
+	assert.Len(t, broker.Pending("cube-admin"), 1)
+}
+
+func TestCanRollbackTransaction(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          ErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "billing",
+			"error":  "Card declined",
+		},
+	})
+	time.Sleep(time.Second)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[0].Compensation)
+	assert.Equal(t, 1, transaction.Stages[0].CompensationAttempts)
+	assert.NotNil(t, transaction.Stages[0].CompensationDeadline)
+	//Backend is asked to roll back the stage it acked
+	pending := broker.Pending("cube-backend")
+	assert.Len(t, pending, 1)
+	assert.Equal(t, RollbackMessage, pending[0].Type)
+	assert.Equal(t, "Card declined", pending[0].Headers["error"])
+	assert.Equal(t, int32(0), pending[0].Headers["stage"])
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          RollbackAckMessage,
+		Headers: map[string]interface{}{
+			"origin": "backend",
+			"stage":  int32(0),
+		},
+	})
+	time.Sleep(time.Second)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRolledBack, transaction.Status)
+	assert.Equal(t, models.CompensationCompleted, transaction.Stages[0].Compensation)
+	assert.Nil(t, transaction.Stages[0].CompensationError)
+}
+
+func TestCanRetryFailedCompensation(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+				CompensationAttempts: 2,
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          ErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "billing",
+			"error":  "Card declined",
+		},
+	})
+	rollbackError := Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          RollbackErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "backend",
+			"stage":  int32(0),
+			"error":  "Cannot remove the invoice",
+		},
+	}
+	//The first failure is retried
+	transport.Publish("cubequeue", rollbackError)
+	time.Sleep(time.Second)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[0].Compensation)
+	assert.Equal(t, 2, transaction.Stages[0].CompensationAttempts)
+	assert.Equal(t, "Cannot remove the invoice", *transaction.Stages[0].CompensationError)
+	rollbacks := broker.Pending("cube-backend")
+	assert.Len(t, rollbacks, 2)
+	//The failed compensation is tried again with a new message
+	assert.NotEqual(t, rollbacks[0].ID, rollbacks[1].ID)
+
+	//The second one runs out of attempts
+	transport.Publish("cubequeue", rollbackError)
+	time.Sleep(time.Second)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionCompensationFailed, transaction.Status)
+	assert.Equal(t, models.CompensationFailed, transaction.Stages[0].Compensation)
+	assert.Equal(t, 2, transaction.Stages[0].CompensationAttempts)
+	assert.Len(t, broker.Pending("cube-backend"), 2)
+}
+
+func TestCanResendLostCompensation(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+				CompensationAttempts: 2,
+				CompensationTimeout:  time.Second,
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		WatchdogInterval: 200 * time.Millisecond,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	//The orchestrator crashed after saving the failure, but before the rollback started
+	errorMessage := "Card declined"
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionFailed,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+		Stages: []models.TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now()},
+			{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Ack: true, Date: time.Now(), Error: &errorMessage},
+		},
+	})
+	assert.Nil(t, err)
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	time.Sleep(600 * time.Millisecond)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, 1, transaction.Stages[0].CompensationAttempts)
+	assert.Len(t, broker.Pending("cube-backend"), 1)
+
+	//Backend never answers, so the rollback is sent again once it expires
+	time.Sleep(time.Second)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, 2, transaction.Stages[0].CompensationAttempts)
+	assert.NotNil(t, transaction.Stages[0].CompensationError)
+	rollbacks := broker.Pending("cube-backend")
+	assert.Len(t, rollbacks, 2)
+	//The same message is sent again, so backend does not compensate twice if only its answer was lost
+	assert.NotEmpty(t, rollbacks[0].ID)
+	assert.Equal(t, rollbacks[0].ID, rollbacks[1].ID)
+
+	//Finally the orchestrator gives up on the compensation
+	time.Sleep(1500 * time.Millisecond)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionCompensationFailed, transaction.Status)
+	assert.Equal(t, models.CompensationFailed, transaction.Stages[0].Compensation)
+	assert.Len(t, broker.Pending("cube-backend"), 2)
+}
+
+func TestCanRunParallelStages(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+			"shipping": {
+				Description: "Shipping service",
+				Name:        "shipping",
+				Queue:       "cube-shipping",
+			},
+			"admin": {
+				Description: "Admin service",
+				Name:        "admin",
+				Queue:       "cube-admin",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"order.create": {
+				Description: "Transaction for placing an order",
+				Stages: []string{
+					"backend",
+					"fulfilment",
+					"admin",
+				},
+				Groups: map[string][]string{
+					"fulfilment": {"billing", "shipping"},
+				},
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"order.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	time.Sleep(time.Second)
+	//Both services of the group receive the transaction at once
+	assert.Len(t, broker.Pending("cube-billing"), 1)
+	assert.Len(t, broker.Pending("cube-shipping"), 1)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Len(t, transaction.Stages, 3)
+	assert.Equal(t, 1, transaction.Stages[1].Step)
+	assert.Equal(t, 1, transaction.Stages[2].Step)
+	assert.ElementsMatch(t, []string{"billing", "shipping"}, transaction.CurrentServices)
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678","invoiceNumber":"123"}`),
+		Headers: map[string]interface{}{
+			"origin": "billing",
+		},
+	})
+	time.Sleep(time.Second)
+	//Admin waits for shipping
+	assert.Empty(t, broker.Pending("cube-admin"))
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Len(t, transaction.Stages, 3)
+	assert.Equal(t, true, transaction.Stages[1].Ack)
+	assert.Equal(t, false, transaction.Stages[2].Ack)
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678","trackingNumber":"456"}`),
+		Headers: map[string]interface{}{
+			"origin": "shipping",
+		},
+	})
+	time.Sleep(time.Second)
+	assert.Len(t, broker.Pending("cube-admin"), 1)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Len(t, transaction.Stages, 4)
+	assert.Equal(t, true, transaction.Stages[2].Ack)
+	assert.Equal(t, "admin", transaction.Stages[3].Service)
+	assert.Equal(t, 2, transaction.Stages[3].Step)
+	//The changes of both services are merged into the payload
+	assert.Equal(t, "123", transaction.Payload["invoiceNumber"])
+	assert.Equal(t, "456", transaction.Payload["trackingNumber"])
+}
+
+func TestCanCompensateParallelStages(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+			"shipping": {
+				Description: "Shipping service",
+				Name:        "shipping",
+				Queue:       "cube-shipping",
+			},
+			"notification": {
+				Description: "Notification service",
+				Name:        "notification",
+				Queue:       "cube-notification",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"order.create": {
+				Description: "Transaction for placing an order",
+				Stages: []string{
+					"backend",
+					"fulfilment",
+				},
+				Groups: map[string][]string{
+					"fulfilment": {"billing", "shipping", "notification"},
+				},
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"order.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "billing",
+		},
+	})
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          ErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "shipping",
+			"error":  "Address not found",
+		},
+	})
+	time.Sleep(time.Second)
+	//Backend and the sibling that acked are rolled back, notification is still working on the transaction
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Len(t, transaction.Stages, 4)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[0].Compensation)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[1].Compensation)
+	assert.Equal(t, "Address not found", *transaction.Stages[2].Error)
+	assert.Equal(t, models.CompensationStatus(""), transaction.Stages[2].Compensation)
+	assert.Equal(t, models.CompensationStatus(""), transaction.Stages[3].Compensation)
+	assert.Len(t, broker.Pending("cube-backend"), 1)
+	billing := broker.Pending("cube-billing")
+	assert.Len(t, billing, 2)
+	assert.Equal(t, RollbackMessage, billing[1].Type)
+	assert.Equal(t, int32(1), billing[1].Headers["stage"])
+	assert.Len(t, broker.Pending("cube-shipping"), 1)
+	assert.Len(t, broker.Pending("cube-notification"), 1)
+
+	//Notification finishes after the transaction failed, so its work is rolled back too
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "notification",
+		},
+	})
+	time.Sleep(time.Second)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, true, transaction.Stages[3].Ack)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[3].Compensation)
+	notification := broker.Pending("cube-notification")
+	assert.Len(t, notification, 2)
+	assert.Equal(t, RollbackMessage, notification[1].Type)
+	assert.Equal(t, int32(3), notification[1].Headers["stage"])
+
+	//The transaction is rolled back once every compensation is acked
+	for service, stage := range map[string]int32{"backend": 0, "billing": 1, "notification": 3} {
+		transport.Publish("cubequeue", Message{
+			CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+			Type:          RollbackAckMessage,
+			Headers: map[string]interface{}{
+				"origin": service,
+				"stage":  stage,
+			},
+		})
+	}
+	time.Sleep(time.Second)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRolledBack, transaction.Status)
+}
+
+func TestCanTimeoutParallelGroup(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+			"shipping": {
+				Description: "Shipping service",
+				Name:        "shipping",
+				Queue:       "cube-shipping",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"order.create": {
+				Description: "Transaction for placing an order",
+				Stages: []string{
+					"backend",
+					"fulfilment",
+				},
+				Groups: map[string][]string{
+					"fulfilment": {"billing", "shipping"},
+				},
+				//The timeout set for the group applies to each of its services
+				StageSettings: map[string]models.TransactionStageSettings{
+					"fulfilment": {
+						Timeout: time.Second,
+					},
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		WatchdogInterval: 200 * time.Millisecond,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"order.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "order.create",
+		Body:          []byte(`{"orderNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "billing",
+		},
+	})
+	time.Sleep(500 * time.Millisecond)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Equal(t, "fulfilment", transaction.Stages[2].Group)
+	assert.NotNil(t, transaction.Stages[2].Deadline)
+	//Shipping never answers, so the watchdog should fail its stage
+	time.Sleep(1500 * time.Millisecond)
+	transaction, err = database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, "shipping", transaction.Stages[2].Service)
+	assert.NotNil(t, transaction.Stages[2].Error)
+	assert.Nil(t, transaction.Stages[1].Error)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[1].Compensation)
+}
+
+func TestCanSkipStage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := databases.NewTransactionMemoryDatabase()
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"image-processor": {
+				Description: "Image processor",
+				Name:        "image-processor",
+				Queue:       "cube-image-processor",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"image-processor",
+					"billing",
+				},
+				StageSettings: map[string]models.TransactionStageSettings{
+					"image-processor": {
+						Condition: "filename",
+					},
+				},
+			},
+		},
+	}, transport, database, GetDefaultTransactionOrchestratorSettings())
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	//The invoice has no file to process
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	time.Sleep(time.Second)
+	assert.Empty(t, broker.Pending("cube-image-processor"))
+	assert.Len(t, broker.Pending("cube-billing"), 1)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Len(t, transaction.Stages, 3)
+	assert.Equal(t, "image-processor", transaction.Stages[1].Service)
+	assert.Equal(t, true, transaction.Stages[1].Skipped)
+	assert.Empty(t, transaction.Stages[1].Attempts)
+	assert.Equal(t, "billing", transaction.Stages[2].Service)
+	assert.Equal(t, false, transaction.Stages[2].Skipped)
+	assert.Equal(t, false, transaction.Stages[2].Ack)
+	assert.Equal(t, []string{"billing"}, transaction.CurrentServices)
+}
+
+// The database that fails one of the updates, like the orchestrator crashing in the middle of the transition
+type unreliableDatabase struct {
+	ITransactionDatabase
+	lock    sync.Mutex
+	updates int
+	// failAt is the number of the update that fails, starting from 1
+	failAt int
+}
+
+func (database *unreliableDatabase) Update(ctx context.Context, id string, transaction *models.TransactionModel) (*models.TransactionModel, error) {
+	database.lock.Lock()
+	database.updates++
+	failed := database.updates == database.failAt
+	database.lock.Unlock()
+	if failed {
+		return nil, errors.New("The connection is closed")
+	}
+	return database.ITransactionDatabase.Update(ctx, id, transaction)
+}
+
+func TestCanSaveAckWithNextStep(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := &unreliableDatabase{ITransactionDatabase: databases.NewTransactionMemoryDatabase()}
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+			"admin": {
+				Description: "Admin service",
+				Name:        "admin",
+				Queue:       "cube-admin",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+					"admin",
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		RelayInterval: 200 * time.Millisecond,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+		Stages: []models.TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now()},
+			{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Ack: false, Date: time.Now()},
+		},
+	})
+	assert.Nil(t, err)
+	//The ack is saved along with the message to admin, but the orchestrator stops before publishing it
+	database.failAt = 2
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	//The message to admin is kept in the outbox, so the relay publishes it again with the same id
+	transport.Publish("cubequeue", Message{
+		ID:            "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "billing",
+		},
+	})
+	time.Sleep(time.Second)
+	pending := broker.Pending("cube-admin")
+	assert.NotEmpty(t, pending)
+	for _, message := range pending {
+		assert.Equal(t, pending[0].ID, message.ID)
+	}
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Empty(t, transaction.Outbox)
+	assert.Len(t, transaction.Stages, 3)
+	assert.Equal(t, true, transaction.Stages[1].Ack)
+	assert.Equal(t, "admin", transaction.Stages[2].Service)
+}
+
+func TestCanDispatchStepLeftBehind(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := &unreliableDatabase{ITransactionDatabase: databases.NewTransactionMemoryDatabase(), failAt: 1}
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{
+		WatchdogInterval: 200 * time.Millisecond,
+	})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, GetDefaultSubscribeSettings("cubequeue"))
+
+	//The transaction is created, but the orchestrator stops before billing is dispatched
+	transport.Publish("cubequeue", Message{
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          "invoice.create",
+		Body:          []byte(`{"invoiceNumber":"34555678"}`),
+		Headers: map[string]interface{}{
+			"origin": "backend",
+		},
+	})
+	//The watchdog finds the acked step and dispatches the next one
+	time.Sleep(time.Second)
+	assert.Len(t, broker.Pending("cube-billing"), 1)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRunning, transaction.Status)
+	assert.Len(t, transaction.Stages, 2)
+	assert.Equal(t, "billing", transaction.Stages[1].Service)
+}
+
+func TestCanRelayOutboxOfJSONStores(t *testing.T) {
+	directory, err := ioutil.TempDir("", "cubequeue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+	sqlite, err := databases.NewTransactionSQLDatabase("sqlite3", filepath.Join(directory, "cubequeue.db"), "transactions")
+	require.Nil(t, err)
+	bolt, err := databases.NewTransactionBoltDatabase(filepath.Join(directory, "cubequeue.bolt"))
+	require.Nil(t, err)
+	for name, database := range map[string]ITransactionDatabase{"sqlite": sqlite, "bolt": bolt} {
+		broker := NewMemoryBroker()
+		transport := NewTransactionMemoryTransport(broker)
+		orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+			Services: map[string]models.TransactionService{
+				"backend": {
+					Description: "Main backend",
+					Name:        "backend",
+					Queue:       "cube-backend",
+				},
+				"billing": {
+					Description: "Billing service",
+					Name:        "billing",
+					Queue:       "cube-billing",
+				},
+			},
+			Transactions: map[string]models.Transaction{
+				"invoice.create": {
+					Description: "Transaction for invoicing a customer",
+					Stages: []string{
+						"backend",
+						"billing",
+					},
+				},
+			},
+		}, transport, database, TransactionOrchestratorSettings{
+			RelayInterval: 200 * time.Millisecond,
+		})
+		//The orchestrator crashed before publishing the rollback message to backend
+		errorMessage := "Card declined"
+		_, err = database.Create(context.Background(), &models.TransactionModel{
+			ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+			Type:    "invoice.create",
+			Status:  models.TransactionRollingBack,
+			Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+			Stages: []models.TransactionStageModel{
+				{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now(), Compensation: models.CompensationPending, CompensationAttempts: 1},
+				{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Date: time.Now(), Error: &errorMessage},
+			},
+			Outbox: []models.OutboxMessageModel{
+				{
+					ID:    "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+					Queue: "cube-backend",
+					Type:  RollbackMessage,
+					Headers: map[string]interface{}{
+						"error": errorMessage,
+						"stage": int32(0),
+					},
+					Date: time.Now(),
+				},
+			},
+		})
+		assert.Nil(t, err, name)
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error)
+		go func() {
+			stopped <- orchestrator.Run(ctx, RoutingTable{
+				"invoice.create": GetDefaultRoutingHandler(),
+			}, GetDefaultSubscribeSettings("cubequeue"))
+		}()
+		time.Sleep(time.Second)
+		pending := broker.Pending("cube-backend")
+		require.Len(t, pending, 1, name)
+		//The headers saved as json come back as floats, backend sends the stage back as it received it
+		assert.Equal(t, float64(0), pending[0].Headers["stage"], name)
+		transport.Publish("cubequeue", Message{
+			ID:            "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11-result",
+			CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+			Type:          RollbackAckMessage,
+			Headers: map[string]interface{}{
+				"origin": "backend",
+				"stage":  pending[0].Headers["stage"],
+			},
+		})
+		time.Sleep(time.Second)
+		transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+		assert.Nil(t, err, name)
+		assert.Equal(t, models.TransactionRolledBack, transaction.Status, name)
+		assert.Equal(t, models.CompensationCompleted, transaction.Stages[0].Compensation, name)
+		cancel()
+		<-stopped
+	}
+}
+
+func TestCanSaveErrorWithProcessedMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := &unreliableDatabase{ITransactionDatabase: databases.NewTransactionMemoryDatabase()}
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+		Stages: []models.TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now()},
+			{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Ack: false, Date: time.Now()},
+		},
+	})
+	assert.Nil(t, err)
+	//The error is lost along with the message id, so the redelivered error is not taken for a duplicate
+	database.failAt = 1
+	settings := GetDefaultSubscribeSettings("cubequeue")
+	settings.AutoAck = false
+	settings.MaxRedeliveries = 2
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, settings)
+
+	transport.Publish("cubequeue", Message{
+		ID:            "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          ErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "billing",
+			"error":  "Card declined",
+		},
+	})
+	time.Sleep(time.Second)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, "Card declined", *transaction.Stages[1].Error)
+	assert.Equal(t, false, transaction.Stages[1].Ack)
+	assert.True(t, transaction.IsProcessed("6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11"))
+	pending := broker.Pending("cube-backend")
+	assert.Len(t, pending, 1)
+	assert.Equal(t, RollbackMessage, pending[0].Type)
+}
+
+func TestCanResumeOnDuplicateMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	transport := NewTransactionMemoryTransport(broker)
+	database := &unreliableDatabase{ITransactionDatabase: databases.NewTransactionMemoryDatabase()}
+	orchestrator := NewTransactionOrchestrator(&models.TransactionConfig{
+		Services: map[string]models.TransactionService{
+			"backend": {
+				Description: "Main backend",
+				Name:        "backend",
+				Queue:       "cube-backend",
+			},
+			"billing": {
+				Description: "Billing service",
+				Name:        "billing",
+				Queue:       "cube-billing",
+			},
+		},
+		Transactions: map[string]models.Transaction{
+			"invoice.create": {
+				Description: "Transaction for invoicing a customer",
+				Stages: []string{
+					"backend",
+					"billing",
+				},
+			},
+		},
+	}, transport, database, TransactionOrchestratorSettings{})
+	assert.NotNil(t, orchestrator)
+	defer orchestrator.Close()
+	_, err := database.Create(context.Background(), &models.TransactionModel{
+		ID:      "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:    "invoice.create",
+		Status:  models.TransactionRunning,
+		Payload: map[string]interface{}{"invoiceNumber": "34555678"},
+		Stages: []models.TransactionStageModel{
+			{Order: 0, Step: 0, Service: "backend", Queue: "cube-backend", Ack: true, Date: time.Now()},
+			{Order: 1, Step: 1, Service: "billing", Queue: "cube-billing", Ack: false, Date: time.Now()},
+		},
+	})
+	assert.Nil(t, err)
+	//The failure is saved, but the rollback is not, so the redelivered error has to start it without the watchdog
+	database.failAt = 2
+	settings := GetDefaultSubscribeSettings("cubequeue")
+	settings.AutoAck = false
+	settings.MaxRedeliveries = 2
+	go orchestrator.Run(context.Background(), RoutingTable{
+		"invoice.create": GetDefaultRoutingHandler(),
+	}, settings)
+
+	transport.Publish("cubequeue", Message{
+		ID:            "6f1d2b1e-4f0a-4c55-9d1f-2a3e8c0b7d11",
+		CorrelationID: "fa621107-5b79-4e8b-9587-df064f1052b4",
+		Type:          ErrorMessage,
+		Headers: map[string]interface{}{
+			"origin": "billing",
+			"error":  "Card declined",
+		},
+	})
+	time.Sleep(time.Second)
+	transaction, err := database.Find(context.Background(), "fa621107-5b79-4e8b-9587-df064f1052b4")
+	assert.Nil(t, err)
+	assert.Equal(t, models.TransactionRollingBack, transaction.Status)
+	assert.Equal(t, models.CompensationPending, transaction.Stages[0].Compensation)
+	pending := broker.Pending("cube-backend")
+	assert.Len(t, pending, 1)
+	assert.Equal(t, RollbackMessage, pending[0].Type)
+}
@@ -1,18 +1,80 @@
 package cubequeue
 
 import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
-// TransactionTransport is responsible for publishing messages to amqp (for now)
+// Message is the broker neutral envelope of the messages sent between the services and the orchestrator
+type Message struct {
+	// ID is unique for every published message and is kept when the message is redelivered, it is used to recognize the duplicates
+	ID            string
+	Type          string
+	CorrelationID string
+	Headers       map[string]interface{}
+	Body          []byte
+	// Redeliveries is how many times the message was delivered before, it is only known when the broker tracks it
+	Redeliveries int
+}
+
+// ITransactionTransport is a contract that has to be implemented in order to deliver the messages between the services
+type ITransactionTransport interface {
+	Publish(queue string, message Message) error
+	// Subscribe blocks until the context is cancelled and the messages being handled are finished, or the transport is closed
+	Subscribe(ctx context.Context, routingTable RoutingTable, settings SubscribeSettings) error
+	Close()
+}
+
+// TransactionTransport implementation of ITransactionTransport using amqp
+// The transport watches the connection and reconnects with a backoff when it is lost, the consumers are registered again
 type TransactionTransport struct {
+	settings TransactionTransportConnectionSetting
+	lock     sync.Mutex
+	session  *transactionTransportSession
+	//Closed while the session is connected, replaced with a new one when the connection is lost
+	connected chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	//The reason the transport stopped reconnecting, nil when closed by Close
+	failure error
+}
+
+// One connection to the broker along with its channels
+type transactionTransportSession struct {
 	consumer, publisher *amqp.Channel
 	connection          *amqp.Connection
 	queue               amqp.Queue
+	//The publisher channel is in the confirm mode, the messages are published one at a time to match the confirmations
+	publishLock sync.Mutex
+	sequence    uint64
+	confirms    chan amqp.Confirmation
+	returns     chan amqp.Return
+	//Closed once the transport noticed the connection is lost
+	lost chan struct{}
 }
 
+// ErrTransportDisconnected is returned when publishing while the connection to the broker is lost and it is not restored in time
+var ErrTransportDisconnected = errors.New("The transport is disconnected")
+
+// ErrTransportClosed is returned when using the transport after it was closed
+var ErrTransportClosed = errors.New("The transport is closed")
+
+// ErrMessageUnroutable is returned when the mandatory message cannot be routed to any queue, for example the queue name is misspelled
+var ErrMessageUnroutable = errors.New("The message cannot be routed to the queue")
+
+// ErrMessageNacked is returned when the broker refused to take the message
+var ErrMessageNacked = errors.New("The message was rejected by the broker")
+
+// ErrPublishNotConfirmed is returned when the broker does not confirm the message in time
+var ErrPublishNotConfirmed = errors.New("The message was not confirmed by the broker")
+
 // TransactionTransportConnectionQueueSettings stores settings for declaring a listening queue
 // The most important one is the queue name, other settings can be left to default
 type TransactionTransportConnectionQueueSettings struct {
@@ -36,30 +98,146 @@ func GetDefaultQueueSetting(queueName string) TransactionTransportConnectionQueu
 	}
 }
 
+// TransactionTransportReconnectSettings defines how the transport behaves when the connection to the broker is lost
+type TransactionTransportReconnectSettings struct {
+	// Backoff between the reconnection attempts, MaxAttempts of zero means reconnecting until the transport is closed
+	Backoff models.RetryPolicy
+	// PublishTimeout is how long Publish waits for the connection to be restored before failing with ErrTransportDisconnected
+	PublishTimeout time.Duration
+}
+
+// GetDefaultReconnectSettings returns default settings, the transport reconnects forever
+func GetDefaultReconnectSettings() TransactionTransportReconnectSettings {
+	return TransactionTransportReconnectSettings{
+		Backoff: models.RetryPolicy{
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		PublishTimeout: 5 * time.Second,
+	}
+}
+
+// TransactionTransportPublishSettings defines how the published messages are confirmed by the broker
+type TransactionTransportPublishSettings struct {
+	// Mandatory messages that cannot be routed to any queue fail with ErrMessageUnroutable instead of being dropped
+	Mandatory bool
+	// ConfirmTimeout is how long Publish waits for the broker to confirm the message, the default one is used if not set
+	ConfirmTimeout time.Duration
+}
+
+// GetDefaultPublishSettings returns default settings
+func GetDefaultPublishSettings() TransactionTransportPublishSettings {
+	return TransactionTransportPublishSettings{
+		Mandatory:      false,
+		ConfirmTimeout: 5 * time.Second,
+	}
+}
+
 // TransactionTransportConnectionSetting stores connection settings for the transport
 type TransactionTransportConnectionSetting struct {
 	URL   string
 	Queue TransactionTransportConnectionQueueSettings
+	// Reconnect settings, the default ones are used if not set
+	Reconnect TransactionTransportReconnectSettings
+	// Publish settings, the messages are not mandatory by default
+	Publish TransactionTransportPublishSettings
 }
 
 // RoutingTableHandler func for handling the event
-type RoutingTableHandler func(amqp.Delivery) error
+type RoutingTableHandler func(Message) error
 
-// RoutingTable is used to route the requests from amqp
+// RoutingTable is used to route the requests from the transport
 type RoutingTable map[string]RoutingTableHandler
 
 // GetDefaultRoutingHandler returns default - empty handler
 func GetDefaultRoutingHandler() RoutingTableHandler {
-	return func(message amqp.Delivery) error { return nil }
+	return func(message Message) error { return nil }
+}
+
+// Find the handler by the message type and execute it, the no_handler handler is used for unknown types
+// The panic of the handler is returned as an error, so one poison message does not stop the subscription
+func (routingTable RoutingTable) route(message Message) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = errors.Errorf("The handler panicked: %v", recovered)
+		}
+	}()
+	handler, ok := routingTable[message.Type]
+	if !ok {
+		//No handler for the message, then use the no_handler handler
+		handler, ok = routingTable[NoHandlerMessage]
+		if !ok {
+			return errors.Errorf("No handler for the message type %s", message.Type)
+		}
+	}
+	return handler(message)
+}
+
+// Route the message and log the outcome, the error is returned so the transport can act on it
+func (routingTable RoutingTable) handle(message Message) error {
+	logrus.WithField("message", message).Debug("Received message")
+	err := routingTable.route(message)
+	if err != nil {
+		logrus.WithError(err).WithField("message", message).Error("Error happened during transaction execution")
+	}
+	logrus.WithField("message", message).Debug("Processed message")
+	return err
 }
 
 // Important handlers the routing table
 const (
-	NoHandlerMessage = "no_handler"
-	ErrorMessage     = "error"
-	RollbackMessage  = "rollback"
+	NoHandlerMessage     = "no_handler"
+	ErrorMessage         = "error"
+	RollbackMessage      = "rollback"
+	RollbackAckMessage   = "rollback_ack"
+	RollbackErrorMessage = "rollback_error"
 )
 
+// Headers attached to the dead-lettered messages
+const (
+	// DeadLetterErrorHeader keeps the error the message failed with
+	DeadLetterErrorHeader = "x-cubequeue-error"
+	// DeadLetterQueueHeader keeps the queue the message was consumed from, the message is re-injected into it
+	DeadLetterQueueHeader = "x-cubequeue-queue"
+	// DeadLetterDateHeader keeps the time the message was dead-lettered
+	DeadLetterDateHeader = "x-cubequeue-dead-lettered-at"
+)
+
+// Copy the failed message with the failure reason attached as headers
+func deadLetter(message Message, queue string, reason error) Message {
+	headers := map[string]interface{}{}
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	headers[DeadLetterErrorHeader] = reason.Error()
+	headers[DeadLetterQueueHeader] = queue
+	headers[DeadLetterDateHeader] = time.Now().UTC().Format(time.RFC3339)
+	delete(headers, redeliveriesHeader)
+	message.Headers = headers
+	message.Redeliveries = 0
+	return message
+}
+
+// Restore the dead-lettered message and return the queue it should be sent to
+func reinjectedMessage(message Message) (string, Message, error) {
+	queue, ok := message.Headers[DeadLetterQueueHeader].(string)
+	if !ok || queue == "" {
+		return "", message, errors.Errorf("Header %s not given", DeadLetterQueueHeader)
+	}
+	headers := map[string]interface{}{}
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	delete(headers, DeadLetterErrorHeader)
+	delete(headers, DeadLetterQueueHeader)
+	delete(headers, DeadLetterDateHeader)
+	delete(headers, "x-delivery-count")
+	message.Headers = headers
+	message.Redeliveries = 0
+	return queue, message, nil
+}
+
 // SubscribeSettings contains settings when subscribing to the queue
 type SubscribeSettings struct {
 	Queue     string
@@ -68,98 +246,505 @@ type SubscribeSettings struct {
 	Exclusive bool
 	NoLocal   bool
 	NoWait    bool
-	Args      amqp.Table
+	Args      map[string]interface{}
+	// MaxRedeliveries is how many times the failed message is requeued when AutoAck is off, the message is dropped afterwards
+	MaxRedeliveries int
+	// DeadLetterQueue receives the failed messages instead of dropping them, with the failure reason in the headers
+	DeadLetterQueue string
+	// Concurrency is how many messages are handled at the same time, the messages are partitioned by the correlation id
+	Concurrency int
+	// PrefetchCount limits how many unacknowledged messages the broker sends, zero means no limit, it has no effect with AutoAck
+	PrefetchCount int
 }
 
 // GetDefaultSubscribeSettings returns default settings
 func GetDefaultSubscribeSettings(queue string) SubscribeSettings {
 	return SubscribeSettings{
-		Queue:     queue,
-		Consumer:  "",
-		AutoAck:   true,
-		Exclusive: false,
-		NoLocal:   false,
-		NoWait:    false,
-		Args:      nil,
+		Queue:           queue,
+		Consumer:        "",
+		AutoAck:         true,
+		Exclusive:       false,
+		NoLocal:         false,
+		NoWait:          false,
+		Args:            nil,
+		MaxRedeliveries: 5,
+		Concurrency:     1,
+		PrefetchCount:   0,
 	}
 }
 
 // NewTransactionTransport create a new transport
 func NewTransactionTransport(connectionSetting TransactionTransportConnectionSetting) (*TransactionTransport, error) {
-	transport := TransactionTransport{}
+	if connectionSetting.Reconnect == (TransactionTransportReconnectSettings{}) {
+		connectionSetting.Reconnect = GetDefaultReconnectSettings()
+	}
+	if connectionSetting.Publish.ConfirmTimeout <= 0 {
+		connectionSetting.Publish.ConfirmTimeout = GetDefaultPublishSettings().ConfirmTimeout
+	}
+	transport := TransactionTransport{
+		settings:  connectionSetting,
+		connected: make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	err := transport.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &transport, nil
+}
+
+// Open the connection along with the channels and declare the queue we will listen on
+func (transport *TransactionTransport) connect() error {
+	session := &transactionTransportSession{
+		lost: make(chan struct{}),
+	}
 	var err error
-	transport.connection, err = amqp.Dial(connectionSetting.URL)
+	session.connection, err = amqp.Dial(transport.settings.URL)
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot connect to the amqp")
+		return errors.Wrap(err, "Cannot connect to the amqp")
 	}
-	transport.consumer, err = transport.connection.Channel()
+	err = session.open(transport.settings.Queue)
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot create a consumer channel")
+		session.connection.Close()
+		return err
+	}
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	select {
+	case <-transport.closed:
+		//Closed while reconnecting
+		session.connection.Close()
+		return ErrTransportClosed
+	default:
 	}
-	transport.publisher, err = transport.connection.Channel()
+	transport.session = session
+	close(transport.connected)
+	go transport.watch(session, session.connection.NotifyClose(make(chan *amqp.Error, 1)))
+	return nil
+}
+
+func (session *transactionTransportSession) open(queueSettings TransactionTransportConnectionQueueSettings) error {
+	var err error
+	session.consumer, err = session.connection.Channel()
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot create a publisher channel")
+		return errors.Wrap(err, "Cannot create a consumer channel")
 	}
+	session.publisher, err = session.connection.Channel()
+	if err != nil {
+		return errors.Wrap(err, "Cannot create a publisher channel")
+	}
+	err = session.publisher.Confirm(false)
+	if err != nil {
+		return errors.Wrap(err, "Cannot put the publisher channel into the confirm mode")
+	}
+	//Buffered, so the late confirmations of the timed out messages do not block the channel
+	session.confirms = session.publisher.NotifyPublish(make(chan amqp.Confirmation, 16))
+	session.returns = session.publisher.NotifyReturn(make(chan amqp.Return, 16))
 	//Now declare the queue we will listen on for the incoming messages
-	transport.queue, err = transport.consumer.QueueDeclare(
-		connectionSetting.Queue.QueueName,
-		connectionSetting.Queue.Durable,
-		connectionSetting.Queue.AutoDelete,
-		connectionSetting.Queue.Exclusive,
-		connectionSetting.Queue.NoWait,
-		connectionSetting.Queue.Args,
+	session.queue, err = session.consumer.QueueDeclare(
+		queueSettings.QueueName,
+		queueSettings.Durable,
+		queueSettings.AutoDelete,
+		queueSettings.Exclusive,
+		queueSettings.NoWait,
+		queueSettings.Args,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot declare the queue for messages")
+		return errors.Wrap(err, "Cannot declare the queue for messages")
 	}
-	return &transport, nil
+	return nil
+}
+
+// Wait for the connection to be closed and reconnect unless the transport was closed
+func (transport *TransactionTransport) watch(session *transactionTransportSession, notifyClose chan *amqp.Error) {
+	reason := <-notifyClose
+	select {
+	case <-transport.closed:
+		return
+	default:
+	}
+	logrus.WithField("reason", reason).Warn("Lost the connection to the amqp, reconnecting")
+	transport.lock.Lock()
+	transport.connected = make(chan struct{})
+	transport.lock.Unlock()
+	close(session.lost)
+	backoff := transport.settings.Reconnect.Backoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-transport.closed:
+			return
+		case <-time.After(backoff.Backoff(attempt)):
+		}
+		err := transport.connect()
+		if err == nil {
+			logrus.WithField("attempt", attempt).Info("Reconnected to the amqp")
+			return
+		}
+		if err == ErrTransportClosed {
+			return
+		}
+		logrus.WithError(err).WithField("attempt", attempt).Warn("Cannot reconnect to the amqp")
+		if backoff.MaxAttempts > 0 && attempt >= backoff.MaxAttempts {
+			logrus.WithError(err).Error("Giving up reconnecting to the amqp")
+			transport.shutdown(errors.Wrap(err, "Cannot reconnect to the amqp"))
+			return
+		}
+	}
+}
+
+// Return the connected session, waiting for the reconnection until the expired channel fires, nil channel waits forever
+func (transport *TransactionTransport) current(expired <-chan struct{}) (*transactionTransportSession, error) {
+	transport.lock.Lock()
+	connected := transport.connected
+	transport.lock.Unlock()
+	select {
+	case <-transport.closed:
+		return nil, ErrTransportClosed
+	case <-connected:
+	default:
+		select {
+		case <-transport.closed:
+			return nil, ErrTransportClosed
+		case <-connected:
+		case <-expired:
+			return nil, ErrTransportDisconnected
+		}
+	}
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	return transport.session, nil
+}
+
+// Channel that is closed after the duration
+func after(duration time.Duration) <-chan struct{} {
+	expired := make(chan struct{})
+	time.AfterFunc(duration, func() { close(expired) })
+	return expired
 }
 
-// Publish a message to a given queue
-func (transport *TransactionTransport) Publish(queue string, message amqp.Publishing) error {
-	err := transport.publisher.Publish("", queue, false, false, message)
+// Publish a message to a given queue and wait for the broker to confirm it
+// While the connection is lost, the publish waits for the reconnection up to PublishTimeout and fails with ErrTransportDisconnected
+func (transport *TransactionTransport) Publish(queue string, message Message) error {
+	session, err := transport.current(after(transport.settings.Reconnect.PublishTimeout))
+	if err != nil {
+		return errors.Wrap(err, "Cannot publish a message to the queue")
+	}
+	err = session.publish(queue, message, transport.settings.Publish)
 	if err != nil {
 		return errors.Wrap(err, "Cannot publish a message to the queue")
 	}
 	return nil
 }
 
-// Subscribe for messages in current queue
-func (transport *TransactionTransport) Subscribe(routingTable RoutingTable, settings SubscribeSettings) error {
-	messages, err := transport.consumer.Consume(
-		settings.Queue,
-		settings.Consumer,
-		settings.AutoAck,
-		settings.Exclusive,
-		settings.NoLocal,
-		settings.NoWait,
-		settings.Args,
-	)
+func (session *transactionTransportSession) publish(queue string, message Message, settings TransactionTransportPublishSettings) error {
+	session.publishLock.Lock()
+	defer session.publishLock.Unlock()
+	err := session.publisher.Publish("", queue, settings.Mandatory, false, amqp.Publishing{
+		MessageId:     message.ID,
+		Type:          message.Type,
+		CorrelationId: message.CorrelationID,
+		Headers:       amqp.Table(message.Headers),
+		Body:          message.Body,
+	})
 	if err != nil {
-		return errors.Wrap(err, "Cannot register a consumer")
+		return err
 	}
-	for message := range messages {
-		logrus.WithField("message", message).Debug("Received message")
-		if _, ok := routingTable[message.Type]; !ok {
-			//No handler for the message, then use the no_handler handler
-			err = routingTable[NoHandlerMessage](message)
+	session.sequence++
+	expired := time.After(settings.ConfirmTimeout)
+	returns := session.returns
+	returned := false
+	for {
+		select {
+		case unroutable, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			if unroutable.CorrelationId == message.CorrelationID && unroutable.Type == message.Type {
+				returned = true
+			}
+		case confirmation, ok := <-session.confirms:
+			if !ok {
+				return ErrTransportDisconnected
+			}
+			if confirmation.DeliveryTag < session.sequence {
+				//Late confirmation of the message that timed out before
+				continue
+			}
+			if !confirmation.Ack {
+				return ErrMessageNacked
+			}
+			//The broker returns the message before confirming it, so the return is already waiting if there is one
+			for drained := false; !drained && returns != nil; {
+				select {
+				case unroutable, ok := <-returns:
+					if ok && unroutable.CorrelationId == message.CorrelationID && unroutable.Type == message.Type {
+						returned = true
+					}
+					drained = !ok
+				default:
+					drained = true
+				}
+			}
+			if returned {
+				return ErrMessageUnroutable
+			}
+			return nil
+		case <-expired:
+			return ErrPublishNotConfirmed
+		}
+	}
+}
+
+// Subscribe for messages in current queue
+// The messages are handled by Concurrency goroutines, the messages of one transaction are handled in order by the same goroutine
+// The consumer is registered again after the transport reconnects, the function returns once the transport is closed
+// Cancelling the context stops consuming, the function returns after the delivered messages are handled
+func (transport *TransactionTransport) Subscribe(ctx context.Context, routingTable RoutingTable, settings SubscribeSettings) error {
+	pool := newPartitionedPool(settings.Concurrency)
+	defer pool.close()
+	//The tag is needed to cancel the consumer
+	if settings.Consumer == "" {
+		tag, err := NewTransactionID()
+		if err != nil {
+			return err
+		}
+		settings.Consumer = "cubequeue-" + tag
+	}
+	for {
+		session, err := transport.current(ctx.Done())
+		if err != nil {
+			if err == ErrTransportDisconnected {
+				//Cancelled while waiting for the reconnection
+				return nil
+			}
+			return transport.failure
+		}
+		if settings.PrefetchCount > 0 {
+			err = session.consumer.Qos(settings.PrefetchCount, 0, false)
 			if err != nil {
-				logrus.WithError(err).WithField("message", message).Error("Error happened during transaction execution")
+				return errors.Wrap(err, "Cannot set the prefetch count")
 			}
-		} else {
-			err = routingTable[message.Type](message)
+		}
+		messages, err := session.consumer.Consume(
+			settings.Queue,
+			settings.Consumer,
+			settings.AutoAck,
+			settings.Exclusive,
+			settings.NoLocal,
+			settings.NoWait,
+			amqp.Table(settings.Args),
+		)
+		if err == nil {
+			stopped := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					//The broker stops sending the messages and the deliveries channel is closed
+					session.consumer.Cancel(settings.Consumer, false)
+				case <-stopped:
+				}
+			}()
+			for delivery := range messages {
+				delivery := delivery
+				message := Message{
+					ID:            delivery.MessageId,
+					Type:          delivery.Type,
+					CorrelationID: delivery.CorrelationId,
+					Headers:       map[string]interface{}(delivery.Headers),
+					Body:          delivery.Body,
+					Redeliveries:  deliveryCount(delivery),
+				}
+				pool.submit(message.CorrelationID, func() {
+					err := routingTable.handle(message)
+					if settings.AutoAck {
+						if err != nil {
+							session.deadLetter(message, err, settings, transport.settings.Publish)
+						}
+						return
+					}
+					session.acknowledge(delivery, message, err, settings, transport.settings.Publish)
+				})
+			}
+			close(stopped)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !session.connection.IsClosed() {
+			//The connection is fine, so the consumer cannot be registered or the broker closed the channel
 			if err != nil {
-				logrus.WithError(err).WithField("message", message).Error("Error happened during transaction execution")
+				return errors.Wrap(err, "Cannot register a consumer")
 			}
+			return errors.New("The consumer channel was closed by the broker")
+		}
+		select {
+		case <-transport.closed:
+			return transport.failure
+		case <-session.lost:
+			logrus.WithField("queue", settings.Queue).Info("Registering the consumer again after the connection was lost")
 		}
-		logrus.WithField("message", message).Debug("Processed message")
 	}
-	return nil
+}
+
+// Header used to count the redeliveries when the queue does not count them
+const redeliveriesHeader = "x-cubequeue-redeliveries"
+
+// The quorum queues count the deliveries in the x-delivery-count header, for the classic ones the transport keeps its own count
+func deliveryCount(delivery amqp.Delivery) int {
+	count, err := headerInt(delivery.Headers, "x-delivery-count")
+	if err == nil {
+		return count
+	}
+	count, err = headerInt(delivery.Headers, redeliveriesHeader)
+	if err == nil {
+		return count
+	}
+	return 0
+}
+
+// Ack the processed message, the failed one is requeued until it runs out of the redeliveries
+func (session *transactionTransportSession) acknowledge(delivery amqp.Delivery, message Message, handlerError error, settings SubscribeSettings, publishSettings TransactionTransportPublishSettings) {
+	var err error
+	switch {
+	case handlerError == nil:
+		err = delivery.Ack(false)
+	case message.Redeliveries >= settings.MaxRedeliveries:
+		if !session.deadLetter(message, handlerError, settings, publishSettings) {
+			//Keep the message rather than lose it
+			err = delivery.Nack(false, true)
+			break
+		}
+		err = delivery.Ack(false)
+	case delivery.Headers["x-delivery-count"] != nil:
+		err = delivery.Nack(false, true)
+	default:
+		//The classic queue does not count the deliveries, so the message is published again with the count in the header
+		headers := map[string]interface{}{}
+		for key, value := range message.Headers {
+			headers[key] = value
+		}
+		headers[redeliveriesHeader] = int32(message.Redeliveries + 1)
+		requeued := message
+		requeued.Headers = headers
+		err = session.publish(settings.Queue, requeued, publishSettings)
+		if err != nil {
+			logrus.WithError(err).WithField("message", message).Warn("Cannot publish the message again, requeueing it")
+			err = delivery.Nack(false, true)
+			break
+		}
+		err = delivery.Ack(false)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("message", message).Warn("Cannot acknowledge the message")
+	}
+}
+
+// Send the failed message to the dead-letter queue, false is returned if the message could not be kept there
+func (session *transactionTransportSession) deadLetter(message Message, reason error, settings SubscribeSettings, publishSettings TransactionTransportPublishSettings) bool {
+	if settings.DeadLetterQueue == "" {
+		logrus.WithError(reason).WithField("message", message).Error("The message failed and there is no dead-letter queue, dropping it")
+		return true
+	}
+	err := session.publish(settings.DeadLetterQueue, deadLetter(message, settings.Queue, reason), publishSettings)
+	if err != nil {
+		logrus.WithError(err).WithField("message", message).Error("Cannot publish the message to the dead-letter queue")
+		return false
+	}
+	logrus.WithError(reason).WithField("message", message).Warn("The message was dead-lettered")
+	return true
+}
+
+// Reinject moves up to limit messages from the dead-letter queue back to the queues they failed in, zero limit moves all of them
+// The messages without the original queue are left in the dead-letter queue
+func (transport *TransactionTransport) Reinject(deadLetterQueue string, limit int) (int, error) {
+	session, err := transport.current(after(transport.settings.Reconnect.PublishTimeout))
+	if err != nil {
+		return 0, errors.Wrap(err, "Cannot reinject the messages")
+	}
+	skipped := []amqp.Delivery{}
+	defer func() {
+		for _, delivery := range skipped {
+			delivery.Nack(false, true)
+		}
+	}()
+	count := 0
+	for limit <= 0 || count < limit {
+		delivery, ok, err := session.consumer.Get(deadLetterQueue, false)
+		if err != nil {
+			return count, errors.Wrap(err, "Cannot get a message from the dead-letter queue")
+		}
+		if !ok {
+			break
+		}
+		queue, message, err := reinjectedMessage(Message{
+			ID:            delivery.MessageId,
+			Type:          delivery.Type,
+			CorrelationID: delivery.CorrelationId,
+			Headers:       map[string]interface{}(delivery.Headers),
+			Body:          delivery.Body,
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("message", message).Warn("Cannot reinject the message")
+			skipped = append(skipped, delivery)
+			continue
+		}
+		err = session.publish(queue, message, transport.settings.Publish)
+		if err != nil {
+			delivery.Nack(false, true)
+			return count, errors.Wrap(err, "Cannot reinject the message")
+		}
+		err = delivery.Ack(false)
+		if err != nil {
+			return count, errors.Wrap(err, "Cannot remove the message from the dead-letter queue")
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Stop reconnecting and close the current connection
+func (transport *TransactionTransport) shutdown(failure error) {
+	transport.closeOnce.Do(func() {
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		transport.failure = failure
+		close(transport.closed)
+		if transport.session != nil {
+			transport.session.consumer.Close()
+			transport.session.publisher.Close()
+			transport.session.connection.Close()
+		}
+	})
 }
 
 // Close close all connections
 func (transport *TransactionTransport) Close() {
-	transport.consumer.Close()
-	transport.publisher.Close()
-	transport.connection.Close()
+	transport.shutdown(nil)
+}
+
+// Read an integer header, the broker can decode the number into any of the integer types
+func headerInt(headers map[string]interface{}, key string) (int, error) {
+	value, ok := headers[key]
+	if !ok {
+		return 0, errors.Errorf("Header %s not given", key)
+	}
+	switch number := value.(type) {
+	case int:
+		return number, nil
+	case int8:
+		return int(number), nil
+	case int16:
+		return int(number), nil
+	case int32:
+		return int(number), nil
+	case int64:
+		return int(number), nil
+	case float64:
+		//The headers saved as json are decoded as floats
+		if number == math.Trunc(number) {
+			return int(number), nil
+		}
+	}
+	return 0, errors.Errorf("Header %s is not a number", key)
 }
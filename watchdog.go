@@ -0,0 +1,131 @@
+package cubequeue
+
+import (
+	"context"
+	"time"
+
+	"github.com/paladium/cubequeue/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Periodically look for the stages that did not answer in time until the context is cancelled
+func (transactionOrchestrator *TransactionOrchestrator) watch(ctx context.Context) {
+	ticker := time.NewTicker(transactionOrchestrator.settings.WatchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := transactionOrchestrator.checkTimeouts(ctx)
+			if err != nil {
+				logrus.WithError(err).Error("Cannot check the transactions for timeouts")
+			}
+		}
+	}
+}
+
+// The statuses of the in-flight transactions the watchdog looks after
+var watchedStatuses = []models.TransactionStatus{
+	models.TransactionRunning,
+	models.TransactionFailed,
+	models.TransactionRollingBack,
+}
+
+// Go over the in-flight transactions, retry the stages whose backoff is over, fail the ones that expired,
+// dispatch the steps that were not dispatched and send the rollback again to the stages that did not answer it in time
+func (transactionOrchestrator *TransactionOrchestrator) checkTimeouts(ctx context.Context) error {
+	for _, status := range watchedStatuses {
+		transactions, err := transactionOrchestrator.database.FindByStatus(ctx, status)
+		if err != nil {
+			return err
+		}
+		for _, transaction := range transactions {
+			err = transactionOrchestrator.checkLockedTransactionTimeouts(ctx, transaction.ID)
+			if err != nil {
+				logrus.WithError(err).WithField("transaction", transaction.ID).Error("Cannot check the transaction for timeouts")
+			}
+		}
+	}
+	return nil
+}
+
+// The transaction could be changed by a handler since it was listed, so it is loaded again under the lock
+func (transactionOrchestrator *TransactionOrchestrator) checkLockedTransactionTimeouts(ctx context.Context, id string) error {
+	transactionOrchestrator.locks.Lock(id)
+	defer transactionOrchestrator.locks.Unlock(id)
+	transaction, err := transactionOrchestrator.database.Find(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch transaction.Status {
+	case models.TransactionRunning:
+		if transaction.CurrentStepCompleted() && len(transaction.Outbox) == 0 {
+			//The step was acked, but the orchestrator stopped before the next step was dispatched
+			return transactionOrchestrator.resume(ctx, transaction)
+		}
+		return transactionOrchestrator.checkTransactionTimeouts(ctx, transaction, time.Now())
+	case models.TransactionFailed:
+		//The failure was saved, but the orchestrator stopped before the rollback started
+		return transactionOrchestrator.rollback(ctx, transaction)
+	case models.TransactionRollingBack:
+		return transactionOrchestrator.checkCompensationTimeouts(ctx, transaction, time.Now())
+	}
+	return nil
+}
+
+// Check every stage of the current step, the services running in parallel expire independently
+func (transactionOrchestrator *TransactionOrchestrator) checkTransactionTimeouts(ctx context.Context, transaction *models.TransactionModel, now time.Time) error {
+	currentStep := transaction.CurrentStep()
+	retries := []int{}
+	for index, stage := range transaction.Stages {
+		if stage.Step != currentStep {
+			continue
+		}
+		if stage.RetryAt != nil && !now.Before(*stage.RetryAt) {
+			retries = append(retries, index)
+			continue
+		}
+		if stage.Ack || stage.Deadline == nil || now.Before(*stage.Deadline) {
+			continue
+		}
+		err := transactionOrchestrator.timeout(ctx, transaction, index)
+		if err != nil {
+			return err
+		}
+		//The transaction is rolling back now, nothing to retry anymore
+		if transaction.Status != models.TransactionRunning {
+			return nil
+		}
+	}
+	if len(retries) == 0 {
+		return nil
+	}
+	return transactionOrchestrator.dispatch(ctx, transaction, nil, retries...)
+}
+
+// Fail the stage of the transaction, it is either retried or the transaction is rolled back
+func (transactionOrchestrator *TransactionOrchestrator) timeout(ctx context.Context, transaction *models.TransactionModel, index int) error {
+	stage := transaction.Stages[index]
+	logrus.WithField("transaction", transaction.ID).WithField("service", stage.Service).Warn("Stage timed out")
+	return transactionOrchestrator.failStage(ctx, transaction, index, "The service "+stage.Service+" did not answer in time")
+}
+
+// Fail the compensations whose rollback message or its answer was lost, they are sent again until we run out of attempts
+func (transactionOrchestrator *TransactionOrchestrator) checkCompensationTimeouts(ctx context.Context, transaction *models.TransactionModel, now time.Time) error {
+	for index, stage := range transaction.Stages {
+		if stage.Compensation != models.CompensationPending || stage.CompensationDeadline == nil || now.Before(*stage.CompensationDeadline) {
+			continue
+		}
+		logrus.WithField("transaction", transaction.ID).WithField("service", stage.Service).Warn("Compensation timed out")
+		err := transactionOrchestrator.failCompensation(ctx, transaction, index, "The service "+stage.Service+" did not answer the rollback in time", true)
+		if err != nil {
+			return err
+		}
+		//Every compensation finished
+		if transaction.Status != models.TransactionRollingBack {
+			return nil
+		}
+	}
+	return nil
+}